@@ -18,4 +18,6 @@
 # JAVA_OPTS=""
 # java $JAVA_OPTS --class-path target/average-1.0.0-SNAPSHOT.jar dev.morling.onebrc.CalculateAverage_niklastreml
 
-go run src/main/go/niklastreml/main.go
+INPUT=${1:-"measurements.txt"}
+
+target/niklastreml/1brc "$INPUT"
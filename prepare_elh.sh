@@ -15,4 +15,4 @@
 #  limitations under the License.
 #
 
-DOCKER_BUILDKIT=1 docker build -o target/elh src/main/go/elh
+DOCKER_BUILDKIT=1 docker build -f src/main/go/elh/Dockerfile -o target/elh src/main/go
@@ -18,3 +18,5 @@
 # Uncomment below to use sdk
 # source "$HOME/.sdkman/bin/sdkman-init.sh"
 # sdk use java 21.0.1-graal 1>&2
+
+go -C src/main/go/niklastreml build -o ../../../../target/niklastreml/1brc .
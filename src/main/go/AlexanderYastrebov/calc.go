@@ -1,283 +1,279 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"flag"
+	"io"
 	"log"
-	"math"
 	"os"
-	"runtime"
-	"sort"
-	"sync"
+	"strings"
 	"syscall"
-)
 
-type measurement struct {
-	min, max, sum, count int64
-}
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
 
+// Usage:
+//
+//	calc [-format name] [-rounding mode] [-quantiles list] [-hash name] [-stats] [-stats-json file] [-checkpoint file] [-strict] [-skip-invalid] measurements.txt
+//	calc merge [-format name] [-rounding mode] snapshot...
+//	calc daemon [-format name] [-rounding mode] [-tcp addr] [-udp addr] [-http addr] [-shards n]
+//
+// Results written with -format snapshot are merged into the final output by
+// the merge command, e.g. to aggregate daily files without reprocessing them.
+// With -checkpoint only the lines appended to the measurements file since the
+// last run are processed.
+//
+// With -strict every line is validated and invalid lines are reported with
+// their offset and line number, calc fails without output if there are any.
+// With -skip-invalid they are skipped and only their count is reported.
+//
+// With -quantiles the measurements of every station are counted in a
+// histogram and the listed quantiles are written after min/mean/max.
+//
+// With -stats the hash table metrics of every worker are written to stderr,
+// with -stats-json to a file, to tune table sizes and hashes.
+//
+// The daemon command aggregates lines received over TCP and UDP until it is
+// interrupted, snapshots of the current results are served over HTTP.
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("Missing measurements filename")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "merge":
+			mergeMain(os.Args[2:])
+			return
+		case "daemon":
+			daemonMain(os.Args[2:])
+			return
+		}
 	}
 
-	measurements := processFile(os.Args[1])
-
-	ids := make([]string, 0, len(measurements))
-	for id := range measurements {
-		ids = append(ids, id)
+	fs := flag.NewFlagSet("calc", flag.ExitOnError)
+	format := formatFlag(fs)
+	rounding := roundingFlag(fs)
+	checkpointFile := fs.String("checkpoint", "", "process only the lines appended since the last run with this checkpoint file")
+	strict := fs.Bool("strict", false, "report invalid lines with their offset and line number and fail")
+	skipInvalid := fs.Bool("skip-invalid", false, "skip invalid lines and report their count, implies -strict")
+	tableStats := fs.Bool("stats", false, "write hash table metrics of every worker to stderr")
+	tableStatsJSON := fs.String("stats-json", "", "write hash table metrics of every worker as JSON to this file")
+	quantiles := fs.String("quantiles", "", "comma separated quantiles to output after min/mean/max: median, mode or pN, e.g. p50,p99.9")
+	fs.Var(&options.Hash, "hash", "hash of station names, one of: "+strings.Join(aggregate.HashNames(), ", ")+", fnv1a is unseeded and slow on names crafted to collide")
+	fs.Parse(os.Args[1:])
+	encode := encoder(*format)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("Missing measurements filename, use - to read from stdin")
 	}
-	sort.Strings(ids)
 
-	fmt.Print("{")
-	for i, id := range ids {
-		if i > 0 {
-			fmt.Print(", ")
+	qs, err := aggregate.ParseQuantiles(*quantiles)
+	if err != nil {
+		log.Fatalf("Invalid -quantiles: %v", err)
+	}
+	if len(qs) > 0 {
+		if *checkpointFile != "" {
+			log.Fatalf("-quantiles can not be combined with -checkpoint")
 		}
-		m := measurements[id]
-		fmt.Printf("%s=%.1f/%.1f/%.1f", id, round(float64(m.min)/10.0), round(float64(m.sum)/10.0/float64(m.count)), round(float64(m.max)/10.0))
+		options.Histograms = true
 	}
-	fmt.Println("}")
-}
 
-func processFile(filename string) map[string]*measurement {
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Fatalf("Open: %v", err)
+	invalid := 0
+	if *strict || *skipInvalid {
+		if *checkpointFile != "" {
+			log.Fatalf("-strict and -skip-invalid can not be combined with -checkpoint")
+		}
+		options.Strict = true
+		options.OnInvalid = func(e *aggregate.LineError) {
+			if !*skipInvalid {
+				log.Printf("Invalid %v", e)
+			}
+			invalid++
+		}
 	}
-	defer f.Close()
 
-	fi, err := f.Stat()
-	if err != nil {
-		log.Fatalf("Stat: %v", err)
+	var stats []aggregate.TableStats
+	if *tableStats || *tableStatsJSON != "" {
+		options.OnTableStats = func(s aggregate.TableStats) {
+			stats = append(stats, s)
+		}
 	}
 
-	size := fi.Size()
-	if size <= 0 || size != int64(int(size)) {
-		log.Fatalf("Invalid file size: %d", size)
+	var measurements aggregate.Results
+	if *checkpointFile != "" {
+		if fs.Arg(0) == "-" {
+			log.Fatalf("Checkpoints require a measurements file")
+		}
+		measurements = processFileCheckpoint(fs.Arg(0), *checkpointFile)
+	} else if fs.Arg(0) == "-" {
+		measurements = processReader(os.Stdin)
+	} else {
+		measurements = processFile(fs.Arg(0))
 	}
 
-	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
-	if err != nil {
-		log.Fatalf("Mmap: %v", err)
+	if *tableStats {
+		if err := aggregate.WriteTableStats(os.Stderr, stats); err != nil {
+			log.Fatalf("Write stats: %v", err)
+		}
+	}
+	if *tableStatsJSON != "" {
+		writeTableStatsJSON(*tableStatsJSON, stats)
 	}
 
-	defer func() {
-		if err := syscall.Munmap(data); err != nil {
-			log.Fatalf("Munmap: %v", err)
+	if invalid > 0 {
+		if !*skipInvalid {
+			log.Fatalf("Found %d invalid lines", invalid)
 		}
-	}()
+		log.Printf("Skipped %d invalid lines", invalid)
+	}
 
-	return process(data)
+	if err := encode(os.Stdout, measurements, aggregate.EncodeOptions{Quantiles: qs, Rounding: *rounding}); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
 }
 
-func process(data []byte) map[string]*measurement {
-	nChunks := runtime.NumCPU()
+func mergeMain(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	format := formatFlag(fs)
+	rounding := roundingFlag(fs)
+	fs.Parse(args)
+	encode := encoder(*format)
 
-	chunkSize := len(data) / nChunks
-	if chunkSize == 0 {
-		chunkSize = len(data)
+	if fs.NArg() == 0 {
+		log.Fatalf("Missing snapshot filenames")
 	}
 
-	chunks := make([]int, 0, nChunks)
-	offset := 0
-	for offset < len(data) {
-		offset += chunkSize
-		if offset >= len(data) {
-			chunks = append(chunks, len(data))
-			break
-		}
+	if err := encode(os.Stdout, mergeSnapshots(fs.Args()), aggregate.EncodeOptions{Rounding: *rounding}); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
+}
 
-		nlPos := bytes.IndexByte(data[offset:], '\n')
-		if nlPos == -1 {
-			chunks = append(chunks, len(data))
-			break
-		} else {
-			offset += nlPos + 1
-			chunks = append(chunks, offset)
-		}
+// options used for processing measurements, set by the flags of main
+var options aggregate.Options
+
+func writeTableStatsJSON(filename string, stats []aggregate.TableStats) {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Create: %v", err)
 	}
+	if err := aggregate.WriteTableStatsJSON(f, stats); err != nil {
+		log.Fatalf("Write stats: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Write stats: %v", err)
+	}
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(chunks))
-
-	results := make([]map[string]*measurement, len(chunks))
-	start := 0
-	for i, chunk := range chunks {
-		go func(data []byte, i int) {
-			results[i] = processChunk(data)
-			wg.Done()
-		}(data[start:chunk], i)
-		start = chunk
+// formatFlag defines the -format flag selecting one of aggregate.Encoders
+func formatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", "official", "output format, one of: "+strings.Join(aggregate.EncoderNames(), ", "))
+}
+
+// roundingFlag defines the -rounding flag selecting the rounding of means
+func roundingFlag(fs *flag.FlagSet) *round.Mode {
+	m := new(round.Mode)
+	fs.Var(m, "rounding", "rounding of means, one of: "+strings.Join(round.Names(), ", ")+", the official results round half-up")
+	return m
+}
+
+func encoder(format string) aggregate.Encoder {
+	encode := aggregate.Encoders[format]
+	if encode == nil {
+		log.Fatalf("Unknown format %q, use one of: %s", format, strings.Join(aggregate.EncoderNames(), ", "))
 	}
-	wg.Wait()
-
-	measurements := make(map[string]*measurement)
-	for _, r := range results {
-		for id, rm := range r {
-			m := measurements[id]
-			if m == nil {
-				measurements[id] = rm
-			} else {
-				m.min = min(m.min, rm.min)
-				m.max = max(m.max, rm.max)
-				m.sum += rm.sum
-				m.count += rm.count
-			}
+	return encode
+}
+
+// mergeSnapshots merges snapshot files written with -format snapshot
+func mergeSnapshots(filenames []string) aggregate.Results {
+	measurements := make(aggregate.Results)
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Fatalf("Open: %v", err)
+		}
+		snapshot, err := aggregate.ReadSnapshot(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Read %s: %v", filename, err)
 		}
+		measurements.Merge(snapshot)
 	}
 	return measurements
 }
 
-func processChunk(data []byte) map[string]*measurement {
-	// Use fixed size linear probe lookup table
-	const (
-		// use power of 2 for fast modulo calculation,
-		// should be larger than max number of keys which is 10_000
-		entriesSize = 1 << 14
-
-		// use FNV-1a hash
-		fnv1aOffset64 = 14695981039346656037
-		fnv1aPrime64  = 1099511628211
-	)
-
-	type entry struct {
-		m     measurement
-		hash  uint64
-		vlen  int
-		value [128]byte // use power of 2 > 100 for alignment
+func processFile(filename string) aggregate.Results {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Open: %v", err)
 	}
-	entries := make([]entry, entriesSize)
-	entriesCount := 0
-
-	// keep short and inlinable
-	getMeasurement := func(hash uint64, value []byte) *measurement {
-		i := hash & uint64(entriesSize-1)
-		entry := &entries[i]
-
-		// bytes.Equal could be commented to speedup assuming no hash collisions
-		for entry.vlen > 0 && !(entry.hash == hash && bytes.Equal(entry.value[:entry.vlen], value)) {
-			i = (i + 1) & uint64(entriesSize-1)
-			entry = &entries[i]
-		}
+	defer f.Close()
 
-		if entry.vlen == 0 {
-			entry.hash = hash
-			entry.vlen = copy(entry.value[:], value)
-			entriesCount++
-		}
-		return &entry.m
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Stat: %v", err)
 	}
 
-	// assume valid input
-	for len(data) > 0 {
-
-		idHash := uint64(fnv1aOffset64)
-		semiPos := 0
-		for i, b := range data {
-			if b == ';' {
-				semiPos = i
-				break
-			}
+	size := fi.Size()
+	if size <= 0 || size != int64(int(size)) {
+		log.Fatalf("Invalid file size: %d", size)
+	}
 
-			// calculate FNV-1a hash
-			idHash ^= uint64(b)
-			idHash *= fnv1aPrime64
+	compression, err := aggregate.DetectCompression(f, size)
+	if err != nil {
+		log.Fatalf("Read: %v", err)
+	}
+	if compression != aggregate.Uncompressed {
+		// compressed data can not be parsed from the mapped file
+		measurements, err := aggregate.ProcessCompressed(context.Background(), f, size, compression, options)
+		if err != nil {
+			log.Fatalf("Process %v: %v", compression, err)
 		}
+		return measurements
+	}
 
-		idData := data[:semiPos]
-
-		data = data[semiPos+1:]
-
-		var temp int64
-		// parseNumber
-		{
-			negative := data[0] == '-'
-			if negative {
-				data = data[1:]
-			}
+	data, unmap := mmap(f, int(size))
+	defer unmap()
 
-			_ = data[3]
-			if data[1] == '.' {
-				// 1.2\n
-				temp = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
-				data = data[4:]
-				// 12.3\n
-			} else {
-				_ = data[4]
-				temp = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
-				data = data[5:]
-			}
+	return process(data)
+}
 
-			if negative {
-				temp = -temp
-			}
-		}
+// mmap maps size bytes of f, empty files can not be mapped and are nil
+func mmap(f *os.File, size int) (data []byte, unmap func()) {
+	if size == 0 {
+		return nil, func() {}
+	}
 
-		m := getMeasurement(idHash, idData)
-		if m.count == 0 {
-			m.min = temp
-			m.max = temp
-			m.sum = temp
-			m.count = 1
-		} else {
-			m.min = min(m.min, temp)
-			m.max = max(m.max, temp)
-			m.sum += temp
-			m.count++
-		}
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		log.Fatalf("Mmap: %v", err)
 	}
 
-	result := make(map[string]*measurement, entriesCount)
-	for i := range entries {
-		entry := &entries[i]
-		if entry.m.count > 0 {
-			result[string(entry.value[:entry.vlen])] = &entry.m
+	return data, func() {
+		if err := syscall.Munmap(data); err != nil {
+			log.Fatalf("Munmap: %v", err)
 		}
 	}
-	return result
 }
 
-func round(x float64) float64 {
-	return roundJava(x*10.0) / 10.0
-}
-
-// roundJava returns the closest integer to the argument, with ties
-// rounding to positive infinity, see java's Math.round
-func roundJava(x float64) float64 {
-	t := math.Trunc(x)
-	if x < 0.0 && t-x == 0.5 {
-		//return t
-	} else if math.Abs(x-t) >= 0.5 {
-		t += math.Copysign(1, x)
+// processReader processes a stream, e.g. a pipe, which can not be mmapped.
+// Gzip and zstd compressed streams are decompressed.
+func processReader(r io.Reader) aggregate.Results {
+	zr, err := aggregate.NewReader(r)
+	if err != nil {
+		log.Fatalf("Read: %v", err)
 	}
+	defer zr.Close()
 
-	if t == 0 { // check -0
-		return 0.0
+	measurements, err := aggregate.ProcessReader(context.Background(), zr, options)
+	if err != nil {
+		log.Fatalf("Process: %v", err)
 	}
-	return t
+	return measurements
 }
 
-// parseNumber reads decimal number that matches "^-?[0-9]{1,2}[.][0-9]" pattern,
-// e.g.: -12.3, -3.4, 5.6, 78.9 and return the value*10, i.e. -123, -34, 56, 789.
-func parseNumber(data []byte) int64 {
-	negative := data[0] == '-'
-	if negative {
-		data = data[1:]
-	}
-
-	var result int64
-	switch len(data) {
-	// 1.2
-	case 3:
-		result = int64(data[0])*10 + int64(data[2]) - '0'*(10+1)
-	// 12.3
-	case 4:
-		result = int64(data[0])*100 + int64(data[1])*10 + int64(data[3]) - '0'*(100+10+1)
-	}
-
-	if negative {
-		return -result
+func process(data []byte) aggregate.Results {
+	measurements, err := aggregate.ProcessBytes(context.Background(), data, options)
+	if err != nil {
+		log.Fatalf("Process: %v", err)
 	}
-	return result
+	return measurements
 }
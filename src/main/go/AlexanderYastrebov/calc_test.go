@@ -1,62 +1,231 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
+	"compress/gzip"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
 )
 
-func TestRoundJava(t *testing.T) {
-	for _, tc := range []struct {
-		value    float64
-		expected string
-	}{
-		{value: -1.5, expected: "-1.0"},
-		{value: -1.0, expected: "-1.0"},
-		{value: -0.7, expected: "-1.0"},
-		{value: -0.5, expected: "0.0"},
-		{value: -0.3, expected: "0.0"},
-		{value: 0.0, expected: "0.0"},
-		{value: 0.3, expected: "0.0"},
-		{value: 0.5, expected: "1.0"},
-		{value: 0.7, expected: "1.0"},
-		{value: 1.0, expected: "1.0"},
-		{value: 1.5, expected: "2.0"},
-	} {
-		if rounded := roundJava(tc.value); fmt.Sprintf("%.1f", rounded) != tc.expected {
-			t.Errorf("Wrong rounding of %v, expected: %s, got: %.1f", tc.value, tc.expected, rounded)
+func TestProcessFileSamples(t *testing.T) {
+	samples, err := filepath.Glob("../../../test/resources/samples/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+		if err != nil {
+			t.Fatal(err)
 		}
+
+		var out bytes.Buffer
+		if err := aggregate.WriteOfficial(&out, processFile(sample)); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(expected) {
+			t.Errorf("Wrong output for %s, expected:\n%s\ngot:\n%s", sample, expected, out.String())
+		}
+	}
+}
+
+func TestProcessReaderMatchesFile(t *testing.T) {
+	const sample = "../../../test/resources/samples/measurements-complex-utf8.txt"
+
+	f, err := os.Open(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var fromFile, fromReader bytes.Buffer
+	if err := aggregate.WriteOfficial(&fromFile, processFile(sample)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregate.WriteOfficial(&fromReader, processReader(f)); err != nil {
+		t.Fatal(err)
+	}
+	if fromFile.String() != fromReader.String() {
+		t.Errorf("Output differs, file:\n%s\nreader:\n%s", fromFile.String(), fromReader.String())
 	}
 }
 
-func TestParseNumber(t *testing.T) {
-	for _, tc := range []struct {
-		value    string
-		expected string
-	}{
-		{value: "-99.9", expected: "-999"},
-		{value: "-12.3", expected: "-123"},
-		{value: "-1.5", expected: "-15"},
-		{value: "-1.0", expected: "-10"},
-		{value: "0.0", expected: "0"},
-		{value: "0.3", expected: "3"},
-		{value: "12.3", expected: "123"},
-		{value: "99.9", expected: "999"},
+func TestProcessCompressedFile(t *testing.T) {
+	const sample = "../../../test/resources/samples/measurements-complex-utf8.txt"
+
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "measurements.txt.gz")
+	if err := os.WriteFile(filename, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, measurements := range map[string]aggregate.Results{
+		"file":   processFile(filename),
+		"reader": processReader(bytes.NewReader(compressed.Bytes())),
 	} {
-		if number := parseNumber([]byte(tc.value)); fmt.Sprintf("%d", number) != tc.expected {
-			t.Errorf("Wrong parsing of %v, expected: %s, got: %d", tc.value, tc.expected, number)
+		var out bytes.Buffer
+		if err := aggregate.WriteOfficial(&out, measurements); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(expected) {
+			t.Errorf("Wrong %s output, expected:\n%s\ngot:\n%s", name, expected, out.String())
 		}
 	}
 }
 
-var parseNumberSink int64
+func TestMergeSnapshots(t *testing.T) {
+	const sample = "../../../test/resources/samples/measurements-10000-unique-keys.txt"
 
-func BenchmarkParseNumber(b *testing.B) {
-	data1 := []byte("1.2")
-	data2 := []byte("-12.3")
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	for i := 0; i < b.N; i++ {
-		parseNumberSink = parseNumber(data1) + parseNumber(data2)
+	// snapshots of every third line, like daily files
+	var parts [3]bytes.Buffer
+	for i, line := range bytes.SplitAfter(data, []byte("\n")) {
+		parts[i%len(parts)].Write(line)
+	}
+	var snapshots []string
+	for i := range parts {
+		input := filepath.Join(t.TempDir(), "measurements.txt")
+		if err := os.WriteFile(input, parts[i].Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var snapshot bytes.Buffer
+		if err := aggregate.WriteSnapshot(&snapshot, processFile(input)); err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, filepath.Join(t.TempDir(), "measurements.snapshot"))
+		if err := os.WriteFile(snapshots[i], snapshot.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := aggregate.WriteOfficial(&out, mergeSnapshots(snapshots)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(expected) {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestProcessFileLongNames(t *testing.T) {
+	// distinct names sharing the first 128 bytes were merged before
+	long := strings.Repeat("x", 1000)
+	names := []string{long[:128], long[:128] + "a", long[:128] + "b", long}
+
+	expected := make(aggregate.Results)
+	var data bytes.Buffer
+	for i, name := range names {
+		expected.Add(name, int64(i*10))
+		data.WriteString(name + ";" + strconv.Itoa(i) + ".0\n")
+	}
+	filename := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, expectedOut bytes.Buffer
+	if err := aggregate.WriteOfficial(&out, processFile(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregate.WriteOfficial(&expectedOut, expected); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expectedOut.String() {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expectedOut.String(), out.String())
+	}
+}
+
+func TestProcessFileStrict(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, []byte("a;1.0\nb;1\na;3.0\nc;100.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var invalid []string
+	options = aggregate.Options{Strict: true, OnInvalid: func(e *aggregate.LineError) {
+		invalid = append(invalid, e.Error())
+	}}
+	defer func() { options = aggregate.Options{} }()
+
+	var out bytes.Buffer
+	if err := aggregate.WriteOfficial(&out, processFile(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{a=1.0/2.0/3.0}\n"; out.String() != expected {
+		t.Errorf("Wrong output, expected: %s, got: %s", expected, out.String())
+	}
+	expected := []string{`line 2 at offset 6: invalid number "1"`, "line 4 at offset 16: value 100.0 out of range"}
+	if strings.Join(invalid, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong invalid lines, expected: %q, got: %q", expected, invalid)
+	}
+}
+
+func TestProcessFileQuantiles(t *testing.T) {
+	const sample = "../../../test/resources/samples/measurements-3.txt"
+
+	qs, err := aggregate.ParseQuantiles("p50,median,mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options = aggregate.Options{Histograms: true}
+	defer func() { options = aggregate.Options{} }()
+
+	var out bytes.Buffer
+	if err := aggregate.Encoders["official"](&out, processFile(sample), aggregate.EncodeOptions{Quantiles: qs}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Bosaso=-15.0/1.3/20.0/-5.0/0.0/-15.0, Petropavlovsk-Kamchatsky=-9.5/0.0/9.5/-9.5/0.0/-9.5}\n"; out.String() != expected {
+		t.Errorf("Wrong output, expected: %s, got: %s", expected, out.String())
+	}
+}
+
+func TestProcessFileTableStats(t *testing.T) {
+	const sample = "../../../test/resources/samples/measurements-10000-unique-keys.txt"
+
+	var stats []aggregate.TableStats
+	options = aggregate.Options{OnTableStats: func(s aggregate.TableStats) {
+		stats = append(stats, s)
+	}}
+	defer func() { options = aggregate.Options{} }()
+
+	measurements := processFile(sample)
+	stations := 0
+	for _, s := range stats {
+		if s.Occupied != s.Stations || s.MaxProbe < 1 {
+			t.Errorf("Wrong stats: %+v", s)
+		}
+		stations += s.Stations
+	}
+	if len(stats) == 0 || stations < len(measurements) {
+		t.Errorf("Expected stats of tables with %d stations, got: %+v", len(measurements), stats)
 	}
 }
 
@@ -73,7 +242,7 @@ func BenchmarkProcess(b *testing.B) {
 	measurements := process(data)
 	rows := int64(0)
 	for _, m := range measurements {
-		rows += m.count
+		rows += m.Count
 	}
 
 	b.ReportAllocs()
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+// A checkpoint holds the results of an append-only measurements file up to
+// the end of its last complete line, so the next run only processes the lines
+// appended since. The file is identified by device and inode, and by a hash of
+// its first bytes to detect files rewritten in place.
+//
+// The checkpoint file consists of checkpointHeader, its CRC-32C and the
+// results as snapshot.
+type checkpoint struct {
+	checkpointHeader
+	results aggregate.Results
+}
+
+type checkpointHeader struct {
+	Magic      [8]byte
+	Version    uint16
+	Dev, Ino   uint64
+	Offset     int64 // end of the last processed line
+	PrefixLen  int64
+	PrefixHash [sha256.Size]byte
+}
+
+const (
+	checkpointMagic   = "1BRCCKPT"
+	checkpointVersion = 1
+
+	// checkpointPrefixLen is the maximum number of bytes hashed to identify
+	// a file, it is small compared to files worth checkpointing
+	checkpointPrefixLen = 1 << 20
+)
+
+var checkpointTable = crc32.MakeTable(crc32.Castagnoli)
+
+// processFileCheckpoint processes the lines of filename appended since the
+// last run and updates checkpointFile with the results. Files which were
+// truncated or replaced since are processed again from the start. An
+// incomplete last line is left for the next run.
+func processFileCheckpoint(filename, checkpointFile string) aggregate.Results {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Stat: %v", err)
+	}
+
+	size := fi.Size()
+	if size < 0 || size != int64(int(size)) {
+		log.Fatalf("Invalid file size: %d", size)
+	}
+
+	compression, err := aggregate.DetectCompression(f, size)
+	if err != nil {
+		log.Fatalf("Read: %v", err)
+	}
+	if compression != aggregate.Uncompressed {
+		log.Fatalf("Checkpoints of %v compressed files are not supported", compression)
+	}
+
+	data, unmap := mmap(f, int(size))
+	defer unmap()
+
+	st := fi.Sys().(*syscall.Stat_t)
+	cp, err := readCheckpoint(checkpointFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		cp = &checkpoint{results: make(aggregate.Results)}
+	case err != nil:
+		log.Printf("Ignoring checkpoint: %v", err)
+		cp = &checkpoint{results: make(aggregate.Results)}
+	case !cp.matches(uint64(st.Dev), uint64(st.Ino), data):
+		log.Printf("%s was truncated or replaced, processing it again", filename)
+		cp = &checkpoint{results: make(aggregate.Results)}
+	}
+
+	start := int(cp.Offset)
+	end := start + bytes.LastIndexByte(data[start:], '\n') + 1
+
+	// lines are not validated, strict options are rejected by main
+	opts := aggregate.Options{Hash: options.Hash, OnTableStats: options.OnTableStats}
+	measurements, err := aggregate.ProcessBytes(context.Background(), data[start:end], opts)
+	if err != nil {
+		log.Fatalf("Process: %v", err)
+	}
+	cp.results.Merge(measurements)
+
+	cp.Dev, cp.Ino = uint64(st.Dev), uint64(st.Ino)
+	cp.Offset = int64(end)
+	cp.PrefixLen = int64(min(end, checkpointPrefixLen))
+	cp.PrefixHash = sha256.Sum256(data[:cp.PrefixLen])
+	if err := writeCheckpoint(checkpointFile, cp); err != nil {
+		log.Fatalf("Write checkpoint: %v", err)
+	}
+	return cp.results
+}
+
+// matches reports whether the checkpoint is of the file with the given identity
+// and contents
+func (cp *checkpoint) matches(dev, ino uint64, data []byte) bool {
+	return cp.Dev == dev && cp.Ino == ino &&
+		cp.Offset <= int64(len(data)) &&
+		sha256.Sum256(data[:cp.PrefixLen]) == cp.PrefixHash
+}
+
+func readCheckpoint(filename string) (*checkpoint, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cp := &checkpoint{}
+	crc := crc32.New(checkpointTable)
+	var checksum uint32
+	if err := binary.Read(io.TeeReader(f, crc), binary.LittleEndian, &cp.checkpointHeader); err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+	if err := binary.Read(f, binary.LittleEndian, &checksum); err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+	if string(cp.Magic[:]) != checkpointMagic || crc.Sum32() != checksum {
+		return nil, fmt.Errorf("%s is not a valid checkpoint", filename)
+	}
+	if cp.Version != checkpointVersion {
+		return nil, fmt.Errorf("%s has unsupported version %d", filename, cp.Version)
+	}
+	if cp.Offset < 0 || cp.PrefixLen != min(cp.Offset, checkpointPrefixLen) {
+		return nil, fmt.Errorf("%s has invalid offsets", filename)
+	}
+
+	cp.results, err = aggregate.ReadSnapshot(f)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint replaces filename atomically, so an interrupted run keeps
+// the previous checkpoint
+func writeCheckpoint(filename string, cp *checkpoint) error {
+	copy(cp.Magic[:], checkpointMagic)
+	cp.Version = checkpointVersion
+
+	var header bytes.Buffer
+	if err := binary.Write(&header, binary.LittleEndian, &cp.checkpointHeader); err != nil {
+		return err
+	}
+	header.Write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(header.Bytes(), checkpointTable)))
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails after the rename
+
+	if _, err := f.Write(header.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := aggregate.WriteSnapshot(f, cp.results); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+func TestProcessFileCheckpoint(t *testing.T) {
+	data, err := os.ReadFile("../../../test/resources/samples/measurements-complex-utf8.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "measurements.txt")
+	checkpointFile := filepath.Join(dir, "measurements.checkpoint")
+
+	// expect checks the results and checkpoint after processing the first n lines
+	expect := func(t *testing.T, n int) {
+		t.Helper()
+
+		processed := bytes.Join(lines[:n], nil)
+		expected := process(processed)
+		if got := processFileCheckpoint(filename, checkpointFile); !equalOutput(t, got, expected) {
+			t.Errorf("Wrong results after %d lines", n)
+		}
+
+		cp, err := readCheckpoint(checkpointFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp.Offset != int64(len(processed)) {
+			t.Errorf("Wrong checkpoint offset, expected: %d, got: %d", len(processed), cp.Offset)
+		}
+		if !equalOutput(t, cp.results, expected) {
+			t.Errorf("Wrong checkpoint results after %d lines", n)
+		}
+	}
+	write := func(t *testing.T, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendFile := func(t *testing.T, data []byte) {
+		t.Helper()
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		write(t, nil)
+		expect(t, 0)
+	})
+
+	t.Run("append", func(t *testing.T) {
+		appendFile(t, bytes.Join(lines[:3], nil))
+		expect(t, 3)
+
+		// the incomplete line is processed once complete
+		line := lines[3]
+		appendFile(t, line[:len(line)/2])
+		expect(t, 3)
+		appendFile(t, line[len(line)/2:])
+		expect(t, 4)
+
+		expect(t, 4)
+		appendFile(t, bytes.Join(lines[4:], nil))
+		expect(t, len(lines))
+	})
+
+	t.Run("incremental", func(t *testing.T) {
+		// only lines after the checkpoint are processed
+		cp, err := readCheckpoint(checkpointFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp.results.Add("Checkpoint", 123)
+		if err := writeCheckpoint(checkpointFile, cp); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := processFileCheckpoint(filename, checkpointFile)["Checkpoint"]; s == nil || s.Count != 1 {
+			t.Errorf("Expected results of the checkpoint, got: %+v", s)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		write(t, bytes.Join(lines[:2], nil))
+		expect(t, 2)
+	})
+
+	t.Run("rewritten", func(t *testing.T) {
+		// same size, different contents
+		rewritten := bytes.Join(lines[:2], nil)
+		rewritten[0] ^= 'a' ^ 'b'
+		write(t, rewritten)
+
+		expected := process(rewritten)
+		if got := processFileCheckpoint(filename, checkpointFile); !equalOutput(t, got, expected) {
+			t.Errorf("Wrong results of rewritten file")
+		}
+		write(t, bytes.Join(lines[:2], nil))
+		expect(t, 2)
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		// a new file with the same contents gets processed again
+		replacement := filepath.Join(dir, "measurements.new")
+		if err := os.WriteFile(replacement, bytes.Join(lines[:5], nil), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(replacement, filename); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, 5)
+	})
+
+	t.Run("corrupt checkpoint", func(t *testing.T) {
+		cp, err := os.ReadFile(checkpointFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range []int{0, 20, len(cp) - 1} {
+			corrupt := bytes.Clone(cp)
+			corrupt[i] ^= 1
+			if err := os.WriteFile(checkpointFile, corrupt, 0644); err != nil {
+				t.Fatal(err)
+			}
+			expect(t, 5)
+		}
+	})
+}
+
+func equalOutput(t *testing.T, a, b aggregate.Results) bool {
+	t.Helper()
+
+	var outA, outB bytes.Buffer
+	if err := aggregate.WriteOfficial(&outA, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregate.WriteOfficial(&outB, b); err != nil {
+		t.Fatal(err)
+	}
+	return outA.String() == outB.String()
+}
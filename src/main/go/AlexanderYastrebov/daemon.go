@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"hash/maphash"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+const (
+	// maxDaemonLineLen bounds the bytes buffered per connection or UDP
+	// sender for an incomplete line, longer lines are dropped
+	maxDaemonLineLen = 128
+
+	// maxNameLen is the maximum length of station names in bytes
+	maxNameLen = 100
+
+	// readBufferSize is the size of reads from connections, it also fits
+	// any UDP datagram
+	readBufferSize = 64 * 1024
+
+	// batchSize is the number of bytes of lines sent to a shard at once
+	batchSize = 16 * 1024
+
+	// udpSenderTimeout is the idle time after which the incomplete line of
+	// an UDP sender is dropped, maxUDPSenders bounds the senders tracked
+	udpSenderTimeout = time.Minute
+	maxUDPSenders    = 4096
+
+	// shutdownTimeout bounds the wait for snapshot requests on shutdown
+	shutdownTimeout = 5 * time.Second
+)
+
+func daemonMain(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	format := formatFlag(fs)
+	rounding := roundingFlag(fs)
+	tcpAddr := fs.String("tcp", "", "accept name;value lines on this TCP address")
+	udpAddr := fs.String("udp", "", "accept name;value lines on this UDP address")
+	httpAddr := fs.String("http", "", "serve GET /snapshot?format=name with the current results on this address")
+	shards := fs.Int("shards", runtime.NumCPU(), "number of goroutines aggregating the stations")
+	fs.Parse(args)
+	encode := encoder(*format)
+	encodeOptions := aggregate.EncodeOptions{Rounding: *rounding}
+
+	if *tcpAddr == "" && *udpAddr == "" {
+		log.Fatalf("Missing -tcp or -udp address")
+	}
+	if *shards < 1 {
+		log.Fatalf("Invalid -shards %d, must be at least 1", *shards)
+	}
+
+	// the first error of a server stops the daemon
+	errc := make(chan error, 3)
+	serve := func(f func() error) {
+		go func() {
+			if err := f(); err != nil {
+				errc <- err
+			}
+		}()
+	}
+
+	d := newDaemon(*shards)
+	if *tcpAddr != "" {
+		ln, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatalf("Listen: %v", err)
+		}
+		log.Printf("Accepting lines on tcp %v", ln.Addr())
+		serve(func() error { return d.serveTCP(ln) })
+	}
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatalf("Listen: %v", err)
+		}
+		log.Printf("Accepting lines on udp %v", conn.LocalAddr())
+		serve(func() error { return d.servePacket(conn) })
+	}
+	var srv *http.Server
+	if *httpAddr != "" {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatalf("Listen: %v", err)
+		}
+		log.Printf("Serving snapshots on %v", ln.Addr())
+		srv = &http.Server{Handler: d.handler(encodeOptions)}
+		serve(func() error {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-errc:
+		log.Printf("Serve: %v", serveErr)
+	}
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+		cancel()
+	}
+	d.Close()
+	if dropped, invalid := d.dropped.Load(), d.invalid.Load(); dropped > 0 || invalid > 0 {
+		log.Printf("Dropped %d long and %d invalid lines", dropped, invalid)
+	}
+	// the results received until an error are written all the same
+	if err := encode(os.Stdout, d.Snapshot(), encodeOptions); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
+
+// daemon aggregates name;value lines received over TCP and UDP. Stations are
+// sharded across goroutines by name, every shard owns a table which is only
+// locked for snapshots.
+type daemon struct {
+	shards []*shard
+	seed   maphash.Seed
+
+	mu        sync.Mutex
+	closed    bool
+	listeners []interface{ Close() error }
+	conns     map[net.Conn]struct{}
+	receivers sync.WaitGroup // serving goroutines
+	workers   sync.WaitGroup // shard goroutines
+
+	dropped atomic.Int64 // lines longer than maxDaemonLineLen
+	invalid atomic.Int64 // malformed lines and stations beyond the capacity
+}
+
+type shard struct {
+	batches chan []byte
+
+	mu    sync.Mutex
+	table *aggregate.Table
+}
+
+func newDaemon(shards int) *daemon {
+	d := &daemon{
+		seed:  maphash.MakeSeed(),
+		conns: make(map[net.Conn]struct{}),
+	}
+	d.workers.Add(shards)
+	for i := 0; i < shards; i++ {
+		s := &shard{
+			batches: make(chan []byte, 64),
+			table:   aggregate.NewTable(false),
+		}
+		d.shards = append(d.shards, s)
+		go d.aggregate(s)
+	}
+	return d
+}
+
+// aggregate adds the lines sent to s one by one, so a line of a new station
+// beyond the capacity does not affect the others
+func (d *daemon) aggregate(s *shard) {
+	defer d.workers.Done()
+
+	for batch := range s.batches {
+		s.mu.Lock()
+		for len(batch) > 0 {
+			i := bytes.IndexByte(batch, '\n')
+			if err := s.table.Process(batch[:i+1]); err != nil {
+				d.invalid.Add(1)
+			}
+			batch = batch[i+1:]
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Snapshot returns a copy of the current results. Lines which were received
+// but are not aggregated yet are missing.
+func (d *daemon) Snapshot() aggregate.Results {
+	results := make(aggregate.Results)
+	for _, s := range d.shards {
+		s.mu.Lock()
+		r := s.table.Results()
+		s.mu.Unlock()
+		results.Merge(r) // shards have distinct stations
+	}
+	return results
+}
+
+// handler serves the snapshot API, formats other than snapshot are written
+// with o
+func (d *daemon) handler(o aggregate.EncodeOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		format := r.FormValue("format")
+		if format == "" {
+			format = "snapshot"
+		}
+		encode := aggregate.Encoders[format]
+		if encode == nil {
+			http.Error(w, "unknown format "+format, http.StatusBadRequest)
+			return
+		}
+		// encode into a buffer first to reply with an error instead of a
+		// partial snapshot
+		var buf bytes.Buffer
+		if err := encode(&buf, d.Snapshot(), o); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(buf.Bytes())
+	})
+	return mux
+}
+
+// track registers a listener or connection to be closed by Close, it reports
+// false if the daemon is closed already
+func (d *daemon) track(c interface{ Close() error }) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return false
+	}
+	if conn, ok := c.(net.Conn); ok {
+		d.conns[conn] = struct{}{}
+	} else {
+		d.listeners = append(d.listeners, c)
+	}
+	d.receivers.Add(1)
+	return true
+}
+
+func (d *daemon) untrack(c interface{ Close() error }) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if conn, ok := c.(net.Conn); ok {
+		delete(d.conns, conn)
+	}
+	d.receivers.Done()
+}
+
+// Close stops receiving and waits until all received lines are aggregated.
+func (d *daemon) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, ln := range d.listeners {
+		ln.Close()
+	}
+	for conn := range d.conns {
+		conn.Close()
+	}
+	d.mu.Unlock()
+
+	d.receivers.Wait()
+	for _, s := range d.shards {
+		close(s.batches)
+	}
+	d.workers.Wait()
+}
+
+// serveTCP reads lines from the connections accepted by ln until it is closed
+func (d *daemon) serveTCP(ln net.Listener) error {
+	if !d.track(ln) {
+		return ln.Close()
+	}
+	defer d.untrack(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !d.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer d.untrack(conn)
+			defer conn.Close()
+			d.serveConn(conn)
+		}()
+	}
+}
+
+func (d *daemon) serveConn(conn net.Conn) {
+	var lines lineBuffer
+	r := d.newRouter()
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		d.dropped.Add(int64(lines.write(buf[:n], r.add)))
+		if err != nil {
+			// the end of the connection ends the last line
+			d.dropped.Add(int64(lines.write([]byte{'\n'}, r.add)))
+			r.flush()
+			return
+		}
+		r.flush()
+	}
+}
+
+// servePacket reads lines from UDP datagrams until conn is closed. Lines may
+// be split across the datagrams of a sender.
+func (d *daemon) servePacket(conn net.PacketConn) error {
+	if !d.track(conn) {
+		return conn.Close()
+	}
+	defer d.untrack(conn)
+
+	type sender struct {
+		lines    lineBuffer
+		lastSeen time.Time
+	}
+	senders := make(map[string]*sender)
+
+	r := d.newRouter()
+	buf := make([]byte, readBufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		now := time.Now()
+		s := senders[addr.String()]
+		if s == nil {
+			if len(senders) >= maxUDPSenders {
+				// drop the incomplete lines of idle senders, or of
+				// arbitrary ones if there are too many active senders
+				for key, s := range senders {
+					if now.Sub(s.lastSeen) > udpSenderTimeout || len(senders) >= maxUDPSenders {
+						delete(senders, key)
+					}
+				}
+			}
+			s = &sender{}
+			senders[addr.String()] = s
+		}
+		s.lastSeen = now
+
+		d.dropped.Add(int64(s.lines.write(buf[:n], r.add)))
+		r.flush()
+	}
+}
+
+// lineBuffer splits received data into lines. It keeps at most
+// maxDaemonLineLen bytes of an incomplete line, longer lines are dropped
+// up to their newline.
+type lineBuffer struct {
+	buf      []byte
+	dropping bool
+}
+
+// write calls emit with every line completed by data including its newline,
+// and returns the number of dropped lines. The line passed to emit is only
+// valid during the call.
+func (b *lineBuffer) write(data []byte, emit func(line []byte)) (dropped int) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(b.buf)+len(data) > maxDaemonLineLen {
+				b.buf = b.buf[:0]
+				b.dropping = true
+			}
+			if !b.dropping {
+				b.buf = append(b.buf, data...)
+			}
+			return dropped
+		}
+
+		line := data[:i+1]
+		data = data[i+1:]
+		switch {
+		case b.dropping || len(b.buf)+len(line) > maxDaemonLineLen:
+			dropped++
+		case len(b.buf) > 0:
+			emit(append(b.buf, line...))
+		case len(line) > 1: // skip empty lines
+			emit(line)
+		}
+		b.buf = b.buf[:0]
+		b.dropping = false
+	}
+	return dropped
+}
+
+// router batches the lines of a receiver for the shards of their stations
+type router struct {
+	d       *daemon
+	batches [][]byte
+}
+
+func (d *daemon) newRouter() *router {
+	return &router{d: d, batches: make([][]byte, len(d.shards))}
+}
+
+// add adds a line to the batch of its shard, invalid lines are dropped as the
+// parser of the shards assumes valid input
+func (r *router) add(line []byte) {
+	semi := bytes.IndexByte(line, ';')
+	if semi < 1 || semi > maxNameLen || !validValue(line[semi+1:len(line)-1]) {
+		r.d.invalid.Add(1)
+		return
+	}
+	name := line[:semi]
+	i := maphash.Bytes(r.d.seed, name) % uint64(len(r.batches))
+	if r.batches[i] == nil {
+		r.batches[i] = make([]byte, 0, batchSize)
+	}
+	r.batches[i] = append(r.batches[i], line...)
+	if len(r.batches[i]) >= batchSize-maxDaemonLineLen {
+		r.send(int(i))
+	}
+}
+
+// validValue reports whether v is a value in tenths as in -12.3 or 4.5
+func validValue(v []byte) bool {
+	if len(v) > 0 && v[0] == '-' {
+		v = v[1:]
+	}
+	switch len(v) {
+	case 3:
+		return isDigit(v[0]) && v[1] == '.' && isDigit(v[2])
+	case 4:
+		return isDigit(v[0]) && isDigit(v[1]) && v[2] == '.' && isDigit(v[3])
+	}
+	return false
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+// flush sends all batches to their shards
+func (r *router) flush() {
+	for i, batch := range r.batches {
+		if len(batch) > 0 {
+			r.send(i)
+		}
+	}
+}
+
+// send passes the batch to the shard, which owns it from then on
+func (r *router) send(i int) {
+	r.d.shards[i].batches <- r.batches[i]
+	r.batches[i] = nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+func TestLineBuffer(t *testing.T) {
+	long := strings.Repeat("x", maxDaemonLineLen)
+	for _, tc := range []struct {
+		writes  []string
+		lines   []string
+		dropped int
+	}{
+		{[]string{"a;1.0\nb;2.0\n"}, []string{"a;1.0\n", "b;2.0\n"}, 0},
+		{[]string{"a;1", ".0\nb;", "2.0", "\n"}, []string{"a;1.0\n", "b;2.0\n"}, 0},
+		{[]string{"\n\na;1.0\n\n"}, []string{"a;1.0\n"}, 0},
+		{[]string{long[:100] + ";1.0\n"}, []string{long[:100] + ";1.0\n"}, 0},
+		{[]string{long + "\na;1.0\n"}, []string{"a;1.0\n"}, 1},
+		{[]string{long, "x", "x\na;1.0\n"}, []string{"a;1.0\n"}, 1},
+		{[]string{long[:100], long[:100], "\n", "a;1.0\n"}, []string{"a;1.0\n"}, 1},
+		{[]string{long[:100], ";1.0", long, "\n", long, "\nb;2.0\n"}, []string{"b;2.0\n"}, 2},
+	} {
+		var b lineBuffer
+		var lines []string
+		dropped := 0
+		for _, w := range tc.writes {
+			dropped += b.write([]byte(w), func(line []byte) { lines = append(lines, string(line)) })
+			if cap(b.buf) > 2*maxDaemonLineLen {
+				t.Errorf("Buffer of %d bytes for %q", cap(b.buf), tc.writes)
+			}
+		}
+		if !reflect.DeepEqual(lines, tc.lines) || dropped != tc.dropped {
+			t.Errorf("Wrong lines of %q, expected: %q (%d dropped), got: %q (%d dropped)", tc.writes, tc.lines, tc.dropped, lines, dropped)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	const sample = "../../../test/resources/samples/measurements-complex-utf8.txt"
+
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := process(data)
+	expected.Merge(process(data))
+	expected.Add("Oslo", 12)
+
+	d := newDaemon(3)
+	defer d.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.serveTCP(ln)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.servePacket(pc)
+
+	// lines split at random across writes and datagrams
+	rnd := rand.New(rand.NewSource(1))
+	send := func(conn net.Conn, data []byte) {
+		t.Helper()
+		for len(data) > 0 {
+			n := min(1+rnd.Intn(100), len(data))
+			if _, err := conn.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+	}
+
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(tcp, []byte(strings.Repeat("x", 1000)+";1.0\ninvalid\n"))
+	send(tcp, data)
+	send(tcp, []byte("Oslo;1.2")) // ended by closing the connection
+	tcp.Close()
+
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	send(udp, data)
+
+	waitForCount(t, d, expected)
+	if got := d.Snapshot(); !equalOutput(t, got, expected) {
+		t.Errorf("Wrong results, expected:\n%v\ngot:\n%v", expected, got)
+	}
+	if d.dropped.Load() != 1 || d.invalid.Load() != 1 {
+		t.Errorf("Expected 1 dropped and 1 invalid line, got %d and %d", d.dropped.Load(), d.invalid.Load())
+	}
+
+	// snapshot API
+	ts := httptest.NewServer(d.handler(aggregate.EncodeOptions{}))
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	snapshot, err := aggregate.ReadSnapshot(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshot, d.Snapshot()) {
+		t.Errorf("Wrong snapshot")
+	}
+
+	d.Close()
+	if _, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		t.Errorf("Expected closed listener")
+	}
+}
+
+// waitForCount waits until the daemon aggregated as many measurements as
+// expected, UDP datagrams arrive some time after sending
+func waitForCount(t *testing.T, d *daemon, expected aggregate.Results) {
+	t.Helper()
+
+	count := func(r aggregate.Results) (n int64) {
+		for _, s := range r {
+			n += s.Count
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count(d.Snapshot()) < count(expected) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonClose(t *testing.T) {
+	// received lines are aggregated before Close returns
+	d := newDaemon(2)
+	r := d.newRouter()
+	var b lineBuffer
+	b.write([]byte("a;1.0\nb;2.0\na;3.0\n"), r.add)
+	r.flush()
+	d.Close()
+
+	var out bytes.Buffer
+	if err := aggregate.WriteOfficial(&out, d.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{a=1.0/2.0/3.0, b=2.0/2.0/2.0}\n"; out.String() != expected {
+		t.Errorf("Wrong output, expected: %s, got: %s", expected, out.String())
+	}
+}
+
+func TestDaemonSnapshotError(t *testing.T) {
+	// a failed encoding is reported instead of a partial snapshot
+	aggregate.Encoders["failing"] = func(w io.Writer, r aggregate.Results, o aggregate.EncodeOptions) error {
+		io.WriteString(w, "partial")
+		return errors.New("encoding failed")
+	}
+	defer delete(aggregate.Encoders, "failing")
+
+	d := newDaemon(1)
+	defer d.Close()
+	ts := httptest.NewServer(d.handler(aggregate.EncodeOptions{}))
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/snapshot?format=failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError || string(body) != "encoding failed\n" {
+		t.Errorf("Expected status 500 and the error, got %d %q", resp.StatusCode, body)
+	}
+}
@@ -1,3 +1,9 @@
 module github.com/AlexanderYastrebov/1brc
 
-go 1.21.5
+go 1.22
+
+require github.com/niklastreml/1brc-go/src/main/go/aggregate v0.0.0
+
+require github.com/klauspost/compress v1.18.0 // indirect
+
+replace github.com/niklastreml/1brc-go/src/main/go/aggregate => ../aggregate
@@ -0,0 +1,423 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the format of an input detected by its magic bytes.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+
+	// BGZF is gzip made of independent members of at most 64KiB which
+	// carry their own size, as written by bgzip.
+	BGZF
+
+	// SeekableZstd is zstd made of independent frames listed in a seek
+	// table stored in a skippable frame at the end.
+	SeekableZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Uncompressed:
+		return "uncompressed"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case BGZF:
+		return "bgzf"
+	case SeekableZstd:
+		return "seekable zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+const (
+	// gzip header up to the extra field
+	gzipHeaderLen = 12
+	gzipFlagExtra = 1 << 2
+
+	// seek table footer: number of frames, descriptor and magic
+	seekFooterLen        = 9
+	seekFooterMagic      = 0x8f92eab1
+	seekSkippableMagic   = 0x184d2a5e
+	seekFlagChecksum     = 1 << 7
+	seekReservedMask     = 0x7c
+	skippableHeaderLen   = 8
+	seekEntryLen         = 8
+	seekEntryChecksumLen = 4
+)
+
+// detect returns the compression of an input starting with header.
+func detect(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		if _, ok := bgzfBlockSize(header); ok {
+			return BGZF
+		}
+		return Gzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return Zstd
+	}
+	return Uncompressed
+}
+
+// DetectCompression detects the compression of size bytes read from r.
+func DetectCompression(r io.ReaderAt, size int64) (Compression, error) {
+	header := make([]byte, min(size, 512))
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return Uncompressed, err
+	}
+
+	c := detect(header)
+	if c == Zstd && size >= seekFooterLen {
+		footer := make([]byte, seekFooterLen)
+		if _, err := r.ReadAt(footer, size-seekFooterLen); err != nil && err != io.EOF {
+			return Uncompressed, err
+		}
+		if binary.LittleEndian.Uint32(footer[5:]) == seekFooterMagic {
+			c = SeekableZstd
+		}
+	}
+	return c, nil
+}
+
+// NewReader returns a reader which decompresses r if it starts with gzip or
+// zstd magic bytes and reads r as is otherwise.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch detect(header) {
+	case Gzip, BGZF:
+		return gzip.NewReader(br)
+	case Zstd, SeekableZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// ProcessCompressed aggregates name;value lines decompressed from size bytes
+// read from r. Gzip and zstd are decompressed by a single goroutine and
+// parsed like ProcessReader does. The independent blocks of BGZF and
+// seekable zstd are read, decompressed and parsed concurrently in spans of
+// about Options.ChunkSize compressed bytes, ProcessReader's default.
+// Compressed input is read by a single goroutine in strict mode, offsets of
+// invalid lines are in the decompressed data.
+func ProcessCompressed(ctx context.Context, r io.ReaderAt, size int64, c Compression, opts Options) (Results, error) {
+	switch c {
+	case Uncompressed:
+		return Process(ctx, r, size, opts)
+	case Gzip, Zstd:
+		return processStream(ctx, r, size, opts)
+	case BGZF:
+		if opts.Strict {
+			return processStream(ctx, r, size, opts)
+		}
+		return processBGZF(ctx, r, size, opts)
+	case SeekableZstd:
+		if opts.Strict {
+			return processStream(ctx, r, size, opts)
+		}
+		return processSeekableZstd(ctx, r, size, opts)
+	}
+	return nil, fmt.Errorf("unsupported compression: %v", c)
+}
+
+// processStream decompresses size bytes read from r by a single goroutine
+func processStream(ctx context.Context, r io.ReaderAt, size int64, opts Options) (Results, error) {
+	zr, err := NewReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ProcessReader(ctx, zr, opts)
+}
+
+// bgzfBlockSize returns the size of the BGZF block starting with header,
+// stored in the BC subfield of the gzip extra field.
+func bgzfBlockSize(header []byte) (int64, bool) {
+	if len(header) < gzipHeaderLen || !bytes.HasPrefix(header, gzipMagic) || header[3]&gzipFlagExtra == 0 {
+		return 0, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(header[10:]))
+	if len(header) < gzipHeaderLen+xlen {
+		return 0, false
+	}
+
+	extra := header[gzipHeaderLen : gzipHeaderLen+xlen]
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+slen {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return int64(binary.LittleEndian.Uint16(extra[4:])) + 1, true
+		}
+		extra = extra[4+slen:]
+	}
+	return 0, false
+}
+
+func processBGZF(ctx context.Context, r io.ReaderAt, size int64, opts Options) (Results, error) {
+	readers := sync.Pool{New: func() any { return new(gzip.Reader) }}
+
+	// a span of blocks is a valid multi member gzip stream
+	decompress := func(dst, src []byte) ([]byte, error) {
+		zr := readers.Get().(*gzip.Reader)
+		defer readers.Put(zr)
+
+		if err := zr.Reset(bytes.NewReader(src)); err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(dst[:0])
+		_, err := buf.ReadFrom(zr)
+		return buf.Bytes(), err
+	}
+
+	blocks := func(yield func(size int64) error) error {
+		header := make([]byte, gzipHeaderLen)
+		for offset := int64(0); offset < size; {
+			if _, err := r.ReadAt(header[:gzipHeaderLen], offset); err != nil {
+				return fmt.Errorf("BGZF block at offset %d: %w", offset, err)
+			}
+			xlen := int(binary.LittleEndian.Uint16(header[10:]))
+			header = append(header[:gzipHeaderLen], make([]byte, xlen)...)
+			if _, err := r.ReadAt(header[gzipHeaderLen:], offset+gzipHeaderLen); err != nil {
+				return fmt.Errorf("BGZF block at offset %d: %w", offset, err)
+			}
+
+			n, ok := bgzfBlockSize(header)
+			if !ok || offset+n > size {
+				return fmt.Errorf("%w: invalid BGZF block at offset %d", ErrMalformed, offset)
+			}
+			if err := yield(n); err != nil {
+				return err
+			}
+			offset += n
+		}
+		return nil
+	}
+
+	return processBlocks(ctx, r, blocks, decompress, opts)
+}
+
+func processSeekableZstd(ctx context.Context, r io.ReaderAt, size int64, opts Options) (Results, error) {
+	frames, err := readSeekTable(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(opts.concurrency()))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	// a span of frames is a valid zstd stream
+	decompress := func(dst, src []byte) ([]byte, error) {
+		return dec.DecodeAll(src, dst[:0])
+	}
+
+	blocks := func(yield func(size int64) error) error {
+		for _, n := range frames {
+			if err := yield(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return processBlocks(ctx, r, blocks, decompress, opts)
+}
+
+// readSeekTable returns the compressed sizes of the frames of a seekable zstd
+// input, which cover the input up to the seek table.
+func readSeekTable(r io.ReaderAt, size int64) ([]int64, error) {
+	if size < skippableHeaderLen+seekFooterLen {
+		return nil, fmt.Errorf("%w: seek table truncated", ErrMalformed)
+	}
+	footer := make([]byte, seekFooterLen)
+	if _, err := r.ReadAt(footer, size-seekFooterLen); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	descriptor := footer[4]
+	if binary.LittleEndian.Uint32(footer[5:]) != seekFooterMagic || descriptor&seekReservedMask != 0 {
+		return nil, fmt.Errorf("%w: invalid seek table footer", ErrMalformed)
+	}
+	entryLen := int64(seekEntryLen)
+	if descriptor&seekFlagChecksum != 0 {
+		entryLen += seekEntryChecksumLen
+	}
+
+	nFrames := int64(binary.LittleEndian.Uint32(footer))
+	tableLen := skippableHeaderLen + nFrames*entryLen + seekFooterLen
+	if tableLen > size {
+		return nil, fmt.Errorf("%w: seek table of %d frames does not fit in %d bytes", ErrMalformed, nFrames, size)
+	}
+
+	table := make([]byte, tableLen-seekFooterLen)
+	if _, err := r.ReadAt(table, size-tableLen); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table) != seekSkippableMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableLen-skippableHeaderLen {
+		return nil, fmt.Errorf("%w: invalid seek table header", ErrMalformed)
+	}
+
+	frames := make([]int64, nFrames)
+	total := int64(0)
+	for i := range frames {
+		e := table[skippableHeaderLen+int64(i)*entryLen:]
+		frames[i] = int64(binary.LittleEndian.Uint32(e))
+		total += frames[i]
+	}
+	if total != size-tableLen {
+		return nil, fmt.Errorf("%w: seek table covers %d of %d bytes", ErrMalformed, total, size-tableLen)
+	}
+	return frames, nil
+}
+
+// edges holds the partial lines at both ends of a decompressed span.
+type edges struct {
+	head    []byte // up to and including the first newline
+	tail    []byte // after the last newline
+	newline bool   // false if the span is part of a single line held in head
+}
+
+// processBlocks aggregates the lines of consecutive independently compressed
+// blocks of r, whose sizes are passed to yield by blocks. Spans of blocks are
+// read, decompressed and parsed concurrently. Lines crossing spans are put
+// together and parsed once all spans are done.
+func processBlocks(
+	ctx context.Context,
+	r io.ReaderAt,
+	blocks func(yield func(size int64) error) error,
+	decompress func(dst, src []byte) ([]byte, error),
+	opts Options,
+) (Results, error) {
+	spanSize := int64(opts.ChunkSize)
+	if spanSize <= 0 {
+		spanSize = DefaultStreamChunkSize
+	}
+
+	type buffers struct{ compressed, decompressed []byte }
+	bufs := sync.Pool{New: func() any { return new(buffers) }}
+
+	var spans []*edges // written by the producer, read after run
+	results, err := run(ctx, opts, func(ctx context.Context, jobs chan<- job) error {
+		sendSpan := func(offset, n int64) error {
+			e := new(edges)
+			spans = append(spans, e)
+
+			return send(ctx, jobs, func(t *table) error {
+				b := bufs.Get().(*buffers)
+				defer bufs.Put(b)
+
+				if int64(cap(b.compressed)) < n {
+					b.compressed = make([]byte, n)
+				}
+				src := b.compressed[:n]
+				if _, err := r.ReadAt(src, offset); err != nil && err != io.EOF {
+					return err
+				}
+
+				data, err := decompress(b.decompressed, src)
+				if err != nil {
+					return fmt.Errorf("decompress span at offset %d: %w", offset, err)
+				}
+				b.decompressed = data
+
+				first := bytes.IndexByte(data, '\n')
+				if first == -1 {
+					e.head = bytes.Clone(data)
+					return nil
+				}
+				last := bytes.LastIndexByte(data, '\n')
+				e.head = bytes.Clone(data[:first+1])
+				e.tail = bytes.Clone(data[last+1:])
+				e.newline = true
+
+				if err := t.process(data[first+1 : last+1]); err != nil {
+					return fmt.Errorf("%w in span at offset %d", err, offset)
+				}
+				return nil
+			})
+		}
+
+		start, end := int64(0), int64(0)
+		err := blocks(func(n int64) error {
+			end += n
+			if end-start < spanSize {
+				return nil
+			}
+			err := sendSpan(start, end-start)
+			start = end
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if end > start {
+			return sendSpan(start, end-start)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	maxLineLen := opts.maxLineLen()
+	var lines, line []byte
+	for _, e := range spans {
+		line = append(line, e.head...)
+		if len(line) > maxLineLen {
+			return nil, fmt.Errorf("%w: line longer than %d bytes", ErrMalformed, maxLineLen)
+		}
+		if e.newline {
+			lines = append(lines, line...)
+			line = append(line[:0], e.tail...)
+		}
+	}
+	if len(line)+1 > maxLineLen {
+		return nil, fmt.Errorf("%w: line longer than %d bytes", ErrMalformed, maxLineLen)
+	}
+	if len(line) > 0 {
+		// last line of the input
+		lines = append(append(lines, line...), '\n')
+	}
+
+	t := newTable(opts)
+	if err := t.process(lines); err != nil {
+		return nil, fmt.Errorf("%w in lines crossing spans", err)
+	}
+	results.Merge(t.results())
+	return results, nil
+}
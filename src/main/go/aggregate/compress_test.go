@@ -0,0 +1,227 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressors write compressed copies of data, block based formats cut data
+// into blocks of blockSize bytes regardless of lines.
+var compressors = map[Compression]func(t *testing.T, data []byte, blockSize int) []byte{
+	Uncompressed: func(t *testing.T, data []byte, blockSize int) []byte { return data },
+	Gzip:         gzipData,
+	Zstd:         zstdData,
+	BGZF:         bgzfData,
+	SeekableZstd: seekableZstdData,
+}
+
+func gzipData(t *testing.T, data []byte, blockSize int) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte, blockSize int) []byte {
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zw.Close()
+	return zw.EncodeAll(data, nil)
+}
+
+// bgzfEOF is the empty block which ends a BGZF file
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+func bgzfData(t *testing.T, data []byte, blockSize int) []byte {
+	var (
+		out   []byte
+		block bytes.Buffer
+	)
+	zw := gzip.NewWriter(&block)
+	for len(data) > 0 {
+		n := min(blockSize, len(data))
+
+		block.Reset()
+		zw.Reset(&block)
+		zw.Extra = []byte{'B', 'C', 2, 0, 0, 0} // size set below
+		if _, err := zw.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b := block.Bytes()
+		binary.LittleEndian.PutUint16(b[16:], uint16(len(b)-1))
+
+		out = append(out, b...)
+		data = data[n:]
+	}
+	return append(out, bgzfEOF...)
+}
+
+func seekableZstdData(t *testing.T, data []byte, blockSize int) []byte {
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zw.Close()
+
+	var out, table []byte
+	for len(data) > 0 {
+		n := min(blockSize, len(data))
+		frame := zw.EncodeAll(data[:n], nil)
+
+		out = append(out, frame...)
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(n))
+		data = data[n:]
+	}
+	nFrames := len(table) / seekEntryLen
+
+	out = binary.LittleEndian.AppendUint32(out, seekSkippableMagic)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(table)+seekFooterLen))
+	out = append(out, table...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(nFrames))
+	out = append(out, 0) // no checksums
+	return binary.LittleEndian.AppendUint32(out, seekFooterMagic)
+}
+
+func TestDetectCompression(t *testing.T) {
+	data := []byte("Hamburg;12.0\nBulawayo;8.9\n")
+
+	for c, compress := range compressors {
+		compressed := compress(t, data, 10)
+
+		got, err := DetectCompression(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c {
+			t.Errorf("Expected %v, got %v", c, got)
+		}
+	}
+
+	for _, data := range []string{"", "a", "\x1f", "\x28\xb5\x2f"} {
+		got, err := DetectCompression(strings.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != Uncompressed {
+			t.Errorf("Expected %q to be uncompressed, got %v", data, got)
+		}
+	}
+}
+
+func TestProcessCompressedSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		data, err := os.ReadFile(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for c, compress := range compressors {
+			for _, blockSize := range []int{5, 1 << 16} {
+				compressed := compress(t, data, blockSize)
+
+				for _, opts := range []Options{{}, {Concurrency: 3, ChunkSize: 100}} {
+					t.Run(fmt.Sprintf("%s/%v/%d/%+v", filepath.Base(sample), c, blockSize, opts), func(t *testing.T) {
+						results, err := ProcessCompressed(context.Background(), bytes.NewReader(compressed), int64(len(compressed)), c, opts)
+						if err != nil {
+							t.Fatal(err)
+						}
+						assertOfficial(t, results, string(expected))
+
+						zr, err := NewReader(bytes.NewReader(compressed))
+						if err != nil {
+							t.Fatal(err)
+						}
+						defer zr.Close()
+
+						results, err = ProcessReader(context.Background(), zr, opts)
+						if err != nil {
+							t.Fatal(err)
+						}
+						assertOfficial(t, results, string(expected))
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestProcessCompressedMalformed(t *testing.T) {
+	data := []byte("Hamburg;12.0\nBulawayo;8.9\nPalembang;38.8\n")
+
+	bgzf := bgzfData(t, data, 10)
+	seekable := seekableZstdData(t, data, 10)
+	long := bgzfData(t, bytes.Repeat([]byte("a"), 1000), 10)
+
+	for _, tc := range []struct {
+		name string
+		c    Compression
+		data []byte
+	}{
+		{"bgzf truncated", BGZF, bgzf[:len(bgzf)-len(bgzfEOF)-1]},
+		{"bgzf corrupt", BGZF, append(bgzf[:20:20], bgzf[25:]...)},
+		{"bgzf long line", BGZF, long},
+		{"seekable truncated", SeekableZstd, seekable[1:]},
+		{"seekable short", SeekableZstd, seekable[len(seekable)-seekFooterLen:]},
+		{"gzip truncated", Gzip, gzipData(t, data, 0)[:20]},
+	} {
+		_, err := ProcessCompressed(context.Background(), bytes.NewReader(tc.data), int64(len(tc.data)), tc.c, Options{ChunkSize: 1})
+		if err == nil {
+			t.Errorf("Expected error for %s", tc.name)
+		}
+	}
+
+	_, err := ProcessCompressed(context.Background(), bytes.NewReader(long), int64(len(long)), BGZF, Options{})
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected malformed error for long line, got: %v", err)
+	}
+}
+
+func TestNewReaderUncompressed(t *testing.T) {
+	for _, data := range []string{"", "a", "Hamburg;12.0\n"} {
+		r, err := NewReader(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+}
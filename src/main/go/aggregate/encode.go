@@ -0,0 +1,218 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
+
+// Encoder writes r sorted by name with the values selected by o for every
+// station.
+type Encoder func(w io.Writer, r Results, o EncodeOptions) error
+
+// EncodeOptions selects the values written by Encoders in addition to the
+// fields of the format. The zero value writes the official values.
+type EncodeOptions struct {
+	// Quantiles are written after the other fields of every station.
+	Quantiles []Quantile
+
+	// Rounding rounds the means, the official results round half up.
+	Rounding round.Mode
+}
+
+// Encoders maps output format names to their encoders.
+//
+// The json, ndjson and csv formats write one record per station with the
+// fields name, min, mean, max, count, sum, stddev and variance followed by
+// the quantiles. Temperatures and sums are exact decimals, so records can
+// be merged again. The snapshot format holds everything needed to merge
+// with ReadSnapshot and Results.Merge, quantiles are kept in histograms.
+var Encoders = map[string]Encoder{
+	"official": WriteOfficialQuantiles,
+	"json":     WriteJSON,
+	"ndjson":   WriteNDJSON,
+	"csv":      WriteCSV,
+	"snapshot": func(w io.Writer, r Results, _ EncodeOptions) error { return WriteSnapshot(w, r) },
+}
+
+// EncoderNames returns the names of Encoders in ascending order.
+func EncoderNames() []string {
+	names := make([]string, 0, len(Encoders))
+	for name := range Encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteJSON writes r as a JSON array with an object per station on each line.
+func WriteJSON(w io.Writer, r Results, o EncodeOptions) error {
+	return WriteJSONStations(w, r.Sorted(), o)
+}
+
+// WriteJSONStations writes stations in the given order like WriteJSON.
+func WriteJSONStations(w io.Writer, stations []Station, o EncodeOptions) error {
+	if err := checkOverflow(stations); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	enc := newJSONEncoder()
+
+	var buf []byte
+	out.WriteByte('[')
+	for i, s := range stations {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		out.WriteByte('\n')
+		buf = enc.appendObject(buf[:0], s, o)
+		out.Write(buf)
+	}
+	if len(stations) > 0 {
+		out.WriteByte('\n')
+	}
+	out.WriteString("]\n")
+	return out.Flush()
+}
+
+// WriteNDJSON writes r as a JSON object per station and line.
+func WriteNDJSON(w io.Writer, r Results, o EncodeOptions) error {
+	return WriteNDJSONStations(w, r.Sorted(), o)
+}
+
+// WriteNDJSONStations writes stations in the given order like WriteNDJSON.
+func WriteNDJSONStations(w io.Writer, stations []Station, o EncodeOptions) error {
+	if err := checkOverflow(stations); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	enc := newJSONEncoder()
+
+	var buf []byte
+	for _, s := range stations {
+		buf = enc.appendObject(buf[:0], s, o)
+		buf = append(buf, '\n')
+		out.Write(buf)
+	}
+	return out.Flush()
+}
+
+// WriteCSV writes r as CSV with a header line, names are quoted as needed.
+func WriteCSV(w io.Writer, r Results, o EncodeOptions) error {
+	return WriteCSVStations(w, r.Sorted(), o)
+}
+
+// WriteCSVStations writes stations in the given order like WriteCSV.
+func WriteCSVStations(w io.Writer, stations []Station, o EncodeOptions) error {
+	if err := checkOverflow(stations); err != nil {
+		return err
+	}
+
+	out := csv.NewWriter(w)
+
+	header := []string{"name", "min", "mean", "max", "count", "sum", "stddev", "variance"}
+	for _, q := range o.Quantiles {
+		header = append(header, q.Name)
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+
+	var buf []byte
+	tenths := func(t int64) string {
+		buf = AppendTenths(buf[:0], t)
+		return string(buf)
+	}
+
+	record := make([]string, len(header))
+	for _, s := range stations {
+		record[0] = s.Name
+		record[1] = tenths(s.Min)
+		record[2] = tenths(s.MeanRounded(o.Rounding))
+		record[3] = tenths(s.Max)
+		record[4] = strconv.FormatInt(s.Count, 10)
+		record[5] = tenths(s.Sum)
+		record[6] = strconv.FormatFloat(s.Stddev(), 'g', -1, 64)
+		record[7] = strconv.FormatFloat(s.Variance(), 'g', -1, 64)
+		for i, q := range o.Quantiles {
+			record[8+i] = tenths(q.Value(s.Histogram))
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// checkOverflow returns ErrOverflow for the first station whose sums may have
+// overflowed, before anything is written
+func checkOverflow(stations []Station) error {
+	for _, s := range stations {
+		if s.Overflows() {
+			return fmt.Errorf("%w: %s", ErrOverflow, s.Name)
+		}
+	}
+	return nil
+}
+
+// appendFloat appends v with the fewest digits which read back as v
+func appendFloat(b []byte, v float64) []byte {
+	return strconv.AppendFloat(b, v, 'g', -1, 64)
+}
+
+// jsonEncoder builds the JSON objects of stations
+type jsonEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+func newJSONEncoder() *jsonEncoder {
+	e := &jsonEncoder{}
+	e.enc = json.NewEncoder(&e.buf)
+	e.enc.SetEscapeHTML(false)
+	return e
+}
+
+// appendString appends s as a JSON string, invalid UTF-8 is replaced
+func (e *jsonEncoder) appendString(b []byte, s string) []byte {
+	e.buf.Reset()
+	e.enc.Encode(s) // strings can always be encoded
+	return append(b, bytes.TrimSuffix(e.buf.Bytes(), []byte{'\n'})...)
+}
+
+func (e *jsonEncoder) appendObject(b []byte, s Station, o EncodeOptions) []byte {
+	b = append(b, `{"name":`...)
+	b = e.appendString(b, s.Name)
+	b = append(b, `,"min":`...)
+	b = AppendTenths(b, s.Min)
+	b = append(b, `,"mean":`...)
+	b = AppendTenths(b, s.MeanRounded(o.Rounding))
+	b = append(b, `,"max":`...)
+	b = AppendTenths(b, s.Max)
+	b = append(b, `,"count":`...)
+	b = strconv.AppendInt(b, s.Count, 10)
+	b = append(b, `,"sum":`...)
+	b = AppendTenths(b, s.Sum)
+	b = append(b, `,"stddev":`...)
+	b = appendFloat(b, s.Stddev())
+	b = append(b, `,"variance":`...)
+	b = appendFloat(b, s.Variance())
+	for _, q := range o.Quantiles {
+		b = append(b, ',')
+		b = e.appendString(b, q.Name)
+		b = append(b, ':')
+		b = AppendTenths(b, q.Value(s.Histogram))
+	}
+	return append(b, '}')
+}
@@ -0,0 +1,185 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenSamples are the samples with golden files of every encoder in
+// testdata, the large measurements-1.txt is left out
+var goldenSamples = []string{
+	"measurements-10.txt",
+	"measurements-2.txt",
+	"measurements-20.txt",
+	"measurements-3.txt",
+	"measurements-boundaries.txt",
+	"measurements-complex-utf8.txt",
+	"measurements-dot.txt",
+	"measurements-rounding.txt",
+	"measurements-short.txt",
+	"measurements-shortest.txt",
+}
+
+func TestEncodersGolden(t *testing.T) {
+	qs, err := ParseQuantiles("p50,p99,median,mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range goldenSamples {
+		results := readSampleHistograms(t, filepath.Join(samplesDir, sample))
+		base := strings.TrimSuffix(sample, ".txt")
+
+		for _, format := range []string{"json", "ndjson", "csv"} {
+			assertGolden(t, filepath.Join("testdata", base+"."+format), func(out *bytes.Buffer) error {
+				return Encoders[format](out, results, EncodeOptions{})
+			})
+			assertGolden(t, filepath.Join("testdata", base+"-quantiles."+format), func(out *bytes.Buffer) error {
+				return Encoders[format](out, results, EncodeOptions{Quantiles: qs})
+			})
+		}
+	}
+}
+
+func assertGolden(t *testing.T, golden string, write func(out *bytes.Buffer) error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(expected) {
+		t.Errorf("Wrong output for %s, expected:\n%s\ngot:\n%s", golden, expected, out.String())
+	}
+}
+
+func TestEncodersEmpty(t *testing.T) {
+	for format, expected := range map[string]string{
+		"official": "{}\n",
+		"json":     "[]\n",
+		"ndjson":   "",
+		"csv":      "name,min,mean,max,count,sum,stddev,variance\n",
+	} {
+		var out bytes.Buffer
+		if err := Encoders[format](&out, Results{}, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected {
+			t.Errorf("Wrong empty %s output, expected: %q, got: %q", format, expected, out.String())
+		}
+	}
+}
+
+// record is a decoded station of the json, ndjson and csv formats
+type record struct {
+	Name                string
+	Min, Mean, Max, Sum json.Number
+	Count               int64
+	Stddev, Variance    float64
+}
+
+func TestEncodersDecode(t *testing.T) {
+	expected := readSample(t, filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	for _, name := range []string{"a,b", "c=d", `"quoted"`, "<&>", "tab\t", "new\nline", "ü, 東京"} {
+		expected.Add(name, -123)
+		expected.Add(name, 45)
+	}
+
+	decoders := map[string]func(t *testing.T, data []byte) []record{
+		"json": func(t *testing.T, data []byte) []record {
+			var records []record
+			if err := json.Unmarshal(data, &records); err != nil {
+				t.Fatal(err)
+			}
+			return records
+		},
+		"ndjson": func(t *testing.T, data []byte) []record {
+			var records []record
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				var r record
+				if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+					t.Fatal(err)
+				}
+				records = append(records, r)
+			}
+			return records
+		},
+		"csv": func(t *testing.T, data []byte) []record {
+			lines, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records []record
+			for _, l := range lines[1:] {
+				count, err := strconv.ParseInt(l[4], 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stddev, err := strconv.ParseFloat(l[6], 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				variance, err := strconv.ParseFloat(l[7], 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				records = append(records, record{
+					Name: l[0], Min: json.Number(l[1]), Mean: json.Number(l[2]), Max: json.Number(l[3]),
+					Count: count, Sum: json.Number(l[5]), Stddev: stddev, Variance: variance,
+				})
+			}
+			return records
+		},
+	}
+
+	for format, decode := range decoders {
+		var out bytes.Buffer
+		if err := Encoders[format](&out, expected, EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		records := decode(t, out.Bytes())
+		if len(records) != len(expected) {
+			t.Fatalf("Expected %d %s records, got %d", len(expected), format, len(records))
+		}
+		for i, r := range records {
+			s := expected[r.Name]
+			if s == nil {
+				t.Fatalf("Unexpected %s record %q", format, r.Name)
+			}
+			if i > 0 && records[i-1].Name >= r.Name {
+				t.Errorf("Wrong %s order: %q before %q", format, records[i-1].Name, r.Name)
+			}
+
+			tenths := func(t int64) json.Number { return json.Number(AppendTenths(nil, t)) }
+			e := record{
+				Name: r.Name, Min: tenths(s.Min), Mean: tenths(s.Mean()), Max: tenths(s.Max),
+				Count: s.Count, Sum: tenths(s.Sum), Stddev: s.Stddev(), Variance: s.Variance(),
+			}
+			if r != e {
+				t.Errorf("Wrong %s record, expected: %+v, got: %+v", format, e, r)
+			}
+		}
+	}
+}
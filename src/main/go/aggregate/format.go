@@ -0,0 +1,74 @@
+package aggregate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
+
+// AppendTenths appends t/10 formatted with one decimal place, e.g. -123 as -12.3.
+func AppendTenths(b []byte, t int64) []byte {
+	if t < 0 {
+		b = append(b, '-')
+		t = -t
+	}
+	b = strconv.AppendInt(b, t/10, 10)
+	return append(b, '.', byte('0'+t%10))
+}
+
+// AppendStats appends s in the official min/mean/max format with the mean
+// rounded in mode m.
+func AppendStats(b []byte, s *Stats, m round.Mode) []byte {
+	b = AppendTenths(b, s.Min)
+	b = append(b, '/')
+	b = AppendTenths(b, s.MeanRounded(m))
+	b = append(b, '/')
+	return AppendTenths(b, s.Max)
+}
+
+// AppendQuantiles appends sep and the value of each of qs for s,
+// s must have a Histogram unless qs is empty.
+func AppendQuantiles(b []byte, s *Stats, qs []Quantile, sep byte) []byte {
+	for _, q := range qs {
+		b = append(b, sep)
+		b = AppendTenths(b, q.Value(s.Histogram))
+	}
+	return b
+}
+
+// WriteOfficial writes r sorted by name in the official
+// {name=min/mean/max, ...} format followed by a newline.
+func WriteOfficial(w io.Writer, r Results) error {
+	return WriteOfficialQuantiles(w, r, EncodeOptions{})
+}
+
+// WriteOfficialQuantiles writes r like WriteOfficial with the values of
+// o.Quantiles appended to min/mean/max, e.g. {name=min/mean/max/p50/p99, ...},
+// and the means rounded in o.Rounding.
+func WriteOfficialQuantiles(w io.Writer, r Results, o EncodeOptions) error {
+	names := r.Names()
+	for _, name := range names {
+		if r[name].Overflows() {
+			return fmt.Errorf("%w: %s", ErrOverflow, name)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	var buf []byte
+	out.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		out.WriteString(name)
+		out.WriteByte('=')
+		buf = AppendStats(buf[:0], r[name], o.Rounding)
+		buf = AppendQuantiles(buf, r[name], o.Quantiles, '/')
+		out.Write(buf)
+	}
+	out.WriteString("}\n")
+	return out.Flush()
+}
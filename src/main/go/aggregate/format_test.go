@@ -0,0 +1,95 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const samplesDir = "../../../test/resources/samples"
+
+func TestAppendTenths(t *testing.T) {
+	for _, v := range []int64{-999, -100, -15, -10, -9, -1, 0, 1, 9, 10, 15, 100, 999, 12345} {
+		if got, expected := string(AppendTenths(nil, v)), fmt.Sprintf("%.1f", float64(v)/10); got != expected {
+			t.Errorf("Wrong formatting of %d, expected: %s, got: %s", v, expected, got)
+		}
+	}
+}
+
+func TestWriteOfficialSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatalf("No samples found in %s", samplesDir)
+	}
+
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			if err := WriteOfficial(&out, readSample(t, sample)); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(expected) {
+				t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+			}
+		})
+	}
+}
+
+func TestResultsMerge(t *testing.T) {
+	a := Results{}
+	a.Add("a", 10)
+	a.Add("b", -10)
+
+	b := Results{}
+	b.Add("b", 30)
+	b.Add("c", 5)
+
+	a.Merge(b)
+
+	var out bytes.Buffer
+	if err := WriteOfficial(&out, a); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{a=1.0/1.0/1.0, b=-1.0/1.0/3.0, c=0.5/0.5/0.5}\n"; out.String() != expected {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+// readSample aggregates a measurements file with the standard library
+func readSample(t *testing.T, filename string) Results {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	results := Results{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, _ := strings.Cut(scanner.Text(), ";")
+		v, err := strconv.ParseInt(strings.Replace(value, ".", "", 1), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results.Add(name, v)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
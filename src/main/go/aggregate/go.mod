@@ -0,0 +1,5 @@
+module github.com/niklastreml/1brc-go/src/main/go/aggregate
+
+go 1.22
+
+require github.com/klauspost/compress v1.18.0
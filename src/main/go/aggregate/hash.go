@@ -0,0 +1,146 @@
+package aggregate
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"strings"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/swar"
+)
+
+// Hash is a function hashing station names for the tables of the workers.
+// The zero value is HashWyhash.
+//
+// Names of unseeded hashes can be crafted to collide, so that every line
+// probes all colliding stations of a table. The seeded hashes take a random
+// seed per table and keep lookups fast on any input.
+type Hash int
+
+const (
+	// HashWyhash is a wyhash-style multiply-mix of 8 bytes at a time,
+	// keyed with a random seed. The parser of Process hashes the words
+	// it scans for the end of names.
+	HashWyhash Hash = iota
+
+	// HashMaphash is hash/maphash with a random seed.
+	HashMaphash
+
+	// HashFNV1a is unseeded FNV-1a of one byte at a time.
+	HashFNV1a
+)
+
+var hashNames = [...]string{
+	HashWyhash:  "wyhash",
+	HashMaphash: "maphash",
+	HashFNV1a:   "fnv1a",
+}
+
+// String returns the name of h accepted by ParseHash.
+func (h Hash) String() string {
+	if h < 0 || int(h) >= len(hashNames) {
+		return fmt.Sprintf("Hash(%d)", int(h))
+	}
+	return hashNames[h]
+}
+
+// HashNames returns the names of all hashes accepted by ParseHash.
+func HashNames() []string {
+	return hashNames[:]
+}
+
+// ParseHash returns the hash with the given name, see HashNames.
+func ParseHash(name string) (Hash, error) {
+	for h, n := range hashNames {
+		if n == name {
+			return Hash(h), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash %q, must be one of: %s", name, strings.Join(HashNames(), ", "))
+}
+
+// Set sets h to the hash with the given name, so a *Hash is a flag.Value.
+func (h *Hash) Set(name string) error {
+	hash, err := ParseHash(name)
+	if err != nil {
+		return err
+	}
+	*h = hash
+	return nil
+}
+
+// Hasher hashes names with a Hash and a seed chosen by NewHasher.
+type Hasher struct {
+	hash Hash
+	seed maphash.Seed
+	key  uint64 // the mixed seed of HashWyhash
+}
+
+// NewHasher returns a Hasher of h with a random seed.
+func NewHasher(h Hash) Hasher {
+	seed := maphash.MakeSeed()
+	key := maphash.Bytes(seed, nil)
+	return Hasher{hash: h, seed: seed, key: key ^ wymix(key^wyp0, wyp1)}
+}
+
+// Sum returns the hash of name.
+func (h *Hasher) Sum(name []byte) uint64 {
+	switch h.hash {
+	case HashMaphash:
+		return maphash.Bytes(h.seed, name)
+	case HashFNV1a:
+		return fnv1a(name)
+	}
+	return wyhash(name, h.key)
+}
+
+const (
+	fnv1aOffset64 = 14695981039346656037
+	fnv1aPrime64  = 1099511628211
+)
+
+func fnv1a(name []byte) uint64 {
+	hash := uint64(fnv1aOffset64)
+	for _, b := range name {
+		hash ^= uint64(b)
+		hash *= fnv1aPrime64
+	}
+	return hash
+}
+
+// secrets of wyhash
+const (
+	wyp0 = 0xa0761d6478bd642f
+	wyp1 = 0xe7037ed1a0b428db
+	wyp2 = 0x8ebc6af09c88c6e3
+	wyp3 = 0x589965cc75374cc3
+)
+
+// wymix multiplies a and b into 128 bits and folds them
+func wymix(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+// wyhash mixes the words of p into the key one at a time with the secrets
+// of wyhash, so that the parser can hash the words it loads to find the end
+// of a name. The last bytes are padded with zeros and mixed with the length.
+func wyhash(p []byte, key uint64) uint64 {
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		key = wyword(key, swar.Load(p))
+	}
+	return wyfinal(key, swar.Load(p), n)
+}
+
+// wyword mixes a word of 8 bytes into the state h
+func wyword(h, w uint64) uint64 {
+	return wymix(w^wyp1, h^wyp2)
+}
+
+// wyfinal mixes the last bytes of a name of n bytes, less than 8 padded with
+// zeros, into the state h
+func wyfinal(h, tail uint64, n int) uint64 {
+	hi, lo := bits.Mul64(tail^wyp1, h^wyp3)
+	return wymix(lo^wyp0^uint64(n), hi^wyp1)
+}
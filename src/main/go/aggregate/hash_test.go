@@ -0,0 +1,178 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseHash(t *testing.T) {
+	for _, name := range HashNames() {
+		h, err := ParseHash(name)
+		if err != nil || h.String() != name {
+			t.Errorf("ParseHash(%q) = %v, %v", name, h, err)
+		}
+	}
+	if _, err := ParseHash("md5"); err == nil {
+		t.Errorf("Expected error for unknown hash")
+	}
+
+	var h Hash
+	if err := h.Set("fnv1a"); err != nil || h != HashFNV1a {
+		t.Errorf("Set(fnv1a) = %v, %v", h, err)
+	}
+	if s := Hash(-1).String(); s != "Hash(-1)" {
+		t.Errorf("Wrong name of invalid hash: %s", s)
+	}
+}
+
+func TestFNV1a(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"":       0xcbf29ce484222325,
+		"a":      0xaf63dc4c8601ec8c,
+		"foobar": 0x85944171f73967e8,
+	} {
+		if got := fnv1a([]byte(s)); got != expected {
+			t.Errorf("Wrong hash of %q, expected: %#x, got: %#x", s, expected, got)
+		}
+	}
+}
+
+func TestHasher(t *testing.T) {
+	// every length, prefixes and names padded with zeros hash differently
+	data := []byte(strings.Repeat("abcdefghijklmnopqrstuvwxyz", 3))
+	for _, hash := range []Hash{HashWyhash, HashMaphash, HashFNV1a} {
+		h := NewHasher(hash)
+		seen := make(map[uint64]string)
+		for n := 0; n <= len(data); n++ {
+			for _, name := range []string{string(data[:n]), string(data[:n]) + "\x00"} {
+				sum := h.Sum([]byte(name))
+				if other, ok := seen[sum]; ok && other != name {
+					t.Errorf("%v: %q and %q collide", hash, other, name)
+				}
+				seen[sum] = name
+				if h.Sum([]byte(name)) != sum {
+					t.Errorf("%v: hash of %q changed", hash, name)
+				}
+			}
+		}
+
+		// seeded hashes depend on the seed
+		other := NewHasher(hash)
+		if seeded := hash != HashFNV1a; seeded == (h.Sum(data) == other.Sum(data)) {
+			t.Errorf("%v: wrong dependency on the seed", hash)
+		}
+	}
+}
+
+// fnvCollisions returns n distinct ASCII names whose FNV-1a
+// hashes have the same lowest 24 bits, so they probe the same entries of
+// tables with up to 1<<24 entries.
+//
+// The lowest bits of FNV-1a only depend on the lowest bits of the state, and
+// the steps can be reversed as the prime is odd. Each name is a hexadecimal
+// prefix whose state is looked up in the states from which a suffix of 4
+// lowercase letters reaches the target: a meet in the middle over 24 bits.
+func fnvCollisions(n int) []string {
+	const bits = 24
+	const mask = 1<<bits - 1
+	const target = 0x1b7c & mask
+
+	// inverse of the prime modulo 2^64 by Newton's iteration
+	inverse := uint64(fnv1aPrime64)
+	for i := 0; i < 5; i++ {
+		inverse *= 2 - fnv1aPrime64*inverse
+	}
+
+	// states before the suffix which end at the target
+	suffixes := make(map[uint64]string)
+	var suffix [4]byte
+	for i := 0; i < 26*26*26*26; i++ {
+		state := uint64(target)
+		for j, k := len(suffix)-1, i; j >= 0; j, k = j-1, k/26 {
+			suffix[j] = byte('a' + k%26)
+			state = (state*inverse)&mask ^ uint64(suffix[j])
+		}
+		suffixes[state] = string(suffix[:])
+	}
+
+	names := make([]string, 0, n)
+	seen := make(map[string]bool)
+	for i := 0; len(names) < n; i++ {
+		prefix := fmt.Sprintf("%x", i)
+		state := fnv1aOffset64 & uint64(mask)
+		for _, b := range []byte(prefix) {
+			state = (state ^ uint64(b)) * fnv1aPrime64 & mask
+		}
+		if suffix, ok := suffixes[state]; ok && !seen[prefix+suffix] {
+			seen[prefix+suffix] = true
+			names = append(names, prefix+suffix)
+		}
+	}
+	return names
+}
+
+func TestFNVCollisions(t *testing.T) {
+	names := fnvCollisions(100)
+	for _, name := range names {
+		if fnv1a([]byte(name))&(1<<24-1) != fnv1a([]byte(names[0]))&(1<<24-1) {
+			t.Fatalf("%q does not collide with %q", name, names[0])
+		}
+	}
+
+	// every hash aggregates colliding names correctly
+	var data strings.Builder
+	var expected []string
+	for i, name := range names {
+		v := i%99 + 1
+		fmt.Fprintf(&data, "%s;%d.0\n%s;-%d.0\n", name, v, name, v)
+		expected = append(expected, fmt.Sprintf("%s=-%d.0/0.0/%d.0", name, v, v))
+	}
+	sort.Strings(expected)
+	for _, hash := range []Hash{HashWyhash, HashMaphash, HashFNV1a} {
+		results, err := ProcessBytes(context.Background(), []byte(data.String()), Options{Concurrency: 2, Hash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, "{"+strings.Join(expected, ", ")+"}\n")
+	}
+}
+
+// BenchmarkProcessCollisions processes lines of names whose FNV-1a hashes
+// collide and of random names with every hash. Unseeded FNV-1a probes all
+// colliding names for every line, the seeded hashes stay as fast as on
+// random names.
+func BenchmarkProcessCollisions(b *testing.B) {
+	const stations, lines = 2000, 200_000
+	rnd := rand.New(rand.NewSource(1))
+	colliding := fnvCollisions(stations)
+	random := make([]string, stations)
+	for i := range random {
+		random[i] = fmt.Sprintf("%016x", rnd.Uint64())[:len(colliding[i])]
+	}
+
+	for _, names := range []struct {
+		kind  string
+		names []string
+	}{{"colliding", colliding}, {"random", random}} {
+		var data bytes.Buffer
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(&data, "%s;%d.%d\n", names.names[rnd.Intn(stations)], rnd.Intn(199)-99, rnd.Intn(10))
+		}
+
+		for _, hash := range []Hash{HashWyhash, HashMaphash, HashFNV1a} {
+			b.Run(fmt.Sprintf("hash=%v/names=%s", hash, names.kind), func(b *testing.B) {
+				b.SetBytes(int64(data.Len()))
+				for i := 0; i < b.N; i++ {
+					if _, err := ProcessBytes(context.Background(), data.Bytes(), Options{Concurrency: 1, Hash: hash}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
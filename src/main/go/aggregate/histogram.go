@@ -0,0 +1,163 @@
+package aggregate
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
+
+const (
+	// MinTenths and MaxTenths bound the measurements, -99.9 and 99.9
+	MinTenths = -999
+	MaxTenths = 999
+
+	histogramSize = MaxTenths - MinTenths + 1
+)
+
+// Histogram counts the measurements of each value from MinTenths to
+// MaxTenths, so quantiles are exact and histograms merge without loss.
+// A single value may be counted up to 2^32-1 times per station.
+type Histogram [histogramSize]uint32
+
+// Add counts a measurement in tenths of a degree, it panics if v is out of
+// range.
+func (h *Histogram) Add(v int64) {
+	h[v-MinTenths]++
+}
+
+// Merge adds all measurements counted by o.
+func (h *Histogram) Merge(o *Histogram) {
+	for i, n := range o {
+		h[i] += n
+	}
+}
+
+// Count returns the number of measurements.
+func (h *Histogram) Count() int64 {
+	count := int64(0)
+	for _, n := range h {
+		count += int64(n)
+	}
+	return count
+}
+
+// Rank returns the value at rank in ascending order, starting at 1.
+// Ranks out of range are clamped to the smallest and largest value.
+// Rank of an empty histogram is 0.
+func (h *Histogram) Rank(rank int64) int64 {
+	last := int64(0)
+	seen := int64(0)
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		last = int64(i) + MinTenths
+		seen += int64(n)
+		if seen >= rank {
+			break
+		}
+	}
+	return last
+}
+
+// Percentile returns the smallest value which is greater than or equal to
+// p/scale of all measurements, i.e. the nearest rank percentile.
+func (h *Histogram) Percentile(p, scale uint64) int64 {
+	// ceil(count * p / scale) without overflow
+	hi, lo := bits.Mul64(uint64(h.Count()), p)
+	rank, rem := bits.Div64(hi, lo, scale)
+	if rem != 0 {
+		rank++
+	}
+	return h.Rank(int64(rank))
+}
+
+// Median returns the middle value, or the mean of the two middle values
+// rounded like Stats.Mean for an even number of measurements.
+func (h *Histogram) Median() int64 {
+	count := h.Count()
+	lower, upper := h.Rank((count+1)/2), h.Rank(count/2+1)
+	return round.HalfUp.Div(lower+upper, 2)
+}
+
+// Mode returns the most frequent value, the smallest one on ties.
+// Mode of an empty histogram is 0.
+func (h *Histogram) Mode() int64 {
+	mode, max := 0, uint32(0)
+	for i, n := range h {
+		if n > max {
+			mode, max = i, n
+		}
+	}
+	if max == 0 {
+		return 0
+	}
+	return int64(mode) + MinTenths
+}
+
+// percentScale allows percentiles with up to three decimal places, e.g. p99.999
+const percentScale = 100_000
+
+// Quantile is a value of the distribution of a station's measurements.
+type Quantile struct {
+	// Name is the name accepted by ParseQuantiles, e.g. p90 or median
+	Name string
+
+	// p is the percentile in 1/percentScale, unused for median and mode
+	p uint64
+}
+
+// Value returns the quantile of h.
+func (q Quantile) Value(h *Histogram) int64 {
+	switch q.Name {
+	case "median":
+		return h.Median()
+	case "mode":
+		return h.Mode()
+	}
+	return h.Percentile(q.p, percentScale)
+}
+
+// ParseQuantiles parses a comma separated list of quantiles: median, mode or
+// pN for the nearest rank N-th percentile with 0 <= N <= 100, e.g. p50,p99.9.
+func ParseQuantiles(s string) ([]Quantile, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var qs []Quantile
+	for _, name := range strings.Split(s, ",") {
+		switch {
+		case name == "median" || name == "mode":
+			qs = append(qs, Quantile{Name: name})
+		case strings.HasPrefix(name, "p"):
+			p, err := parsePercent(name[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quantile %q: %w", name, err)
+			}
+			qs = append(qs, Quantile{Name: name, p: p})
+		default:
+			return nil, fmt.Errorf("invalid quantile %q, must be median, mode or pN", name)
+		}
+	}
+	return qs, nil
+}
+
+// parsePercent parses a percentage with up to three decimal places into
+// 1/percentScale
+func parsePercent(s string) (uint64, error) {
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 3 || strings.ContainsAny(s, "+-") {
+		return 0, fmt.Errorf("must be a number from 0 to 100 with up to 3 decimal places")
+	}
+	frac += strings.Repeat("0", 3-len(frac))
+
+	p, err := strconv.ParseUint(whole+frac, 10, 64)
+	if err != nil || p > percentScale {
+		return 0, fmt.Errorf("must be a number from 0 to 100 with up to 3 decimal places")
+	}
+	return p, nil
+}
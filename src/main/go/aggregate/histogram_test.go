@@ -0,0 +1,231 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
+
+// referenceQuantile computes q of the measurements in values by sorting them
+func referenceQuantile(q Quantile, values []int64) int64 {
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := int64(len(sorted))
+
+	switch q.Name {
+	case "median":
+		return round.HalfUp.Div(sorted[(n-1)/2]+sorted[n/2], 2)
+	case "mode":
+		counts := make(map[int64]int)
+		mode := sorted[0]
+		for _, v := range sorted {
+			counts[v]++
+			if counts[v] > counts[mode] {
+				mode = v
+			}
+		}
+		return mode
+	}
+	rank := (n*int64(q.p) + percentScale - 1) / percentScale
+	return sorted[max(rank, 1)-1]
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	qs, err := ParseQuantiles("p0,p1,p25,p50,p90,p99,p99.9,p100,median,mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		n := 1 + rnd.Intn(2000)
+		spread := 1 + rnd.Intn(histogramSize)
+		values := make([]int64, n)
+
+		var h Histogram
+		for j := range values {
+			values[j] = MinTenths + int64(rnd.Intn(spread))
+			if i%2 == 1 {
+				values[j] = MaxTenths - int64(rnd.Intn(spread))
+			}
+			h.Add(values[j])
+		}
+
+		if h.Count() != int64(n) {
+			t.Fatalf("Expected count %d, got %d", n, h.Count())
+		}
+		for _, q := range qs {
+			if got, expected := q.Value(&h), referenceQuantile(q, values); got != expected {
+				t.Errorf("Wrong %s of %v, expected: %d, got: %d", q.Name, values, expected, got)
+			}
+		}
+	}
+}
+
+func TestHistogramMedian(t *testing.T) {
+	for _, tc := range []struct {
+		values   []int64
+		expected int64
+	}{
+		{[]int64{5}, 5},
+		{[]int64{1, 2}, 2},
+		{[]int64{-2, -1}, -1},
+		{[]int64{-3, -2}, -2},
+		{[]int64{-3, -1}, -2},
+		{[]int64{-999, 999}, 0},
+		{[]int64{1, 2, 3, 100}, 3},
+	} {
+		var h Histogram
+		for _, v := range tc.values {
+			h.Add(v)
+		}
+		if got := h.Median(); got != tc.expected {
+			t.Errorf("Wrong median of %v, expected: %d, got: %d", tc.values, tc.expected, got)
+		}
+	}
+
+	var empty Histogram
+	if empty.Median() != 0 || empty.Mode() != 0 || empty.Percentile(50, 100) != 0 {
+		t.Errorf("Expected zero quantiles of empty histogram")
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+
+	var all, merged Histogram
+	for i := 0; i < 10; i++ {
+		var part Histogram
+		for j := 0; j < 1000; j++ {
+			v := int64(rnd.Intn(histogramSize)) + MinTenths
+			all.Add(v)
+			part.Add(v)
+		}
+		merged.Merge(&part)
+	}
+	if merged != all {
+		t.Errorf("Merged histogram differs")
+	}
+}
+
+func TestParseQuantiles(t *testing.T) {
+	qs, err := ParseQuantiles("p50,p99.9,median,mode,p100,p0.001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, q := range qs {
+		got = append(got, fmt.Sprintf("%s:%d", q.Name, q.p))
+	}
+	if s, expected := strings.Join(got, ","), "p50:50000,p99.9:99900,median:0,mode:0,p100:100000,p0.001:1"; s != expected {
+		t.Errorf("Wrong quantiles, expected: %s, got: %s", expected, s)
+	}
+
+	if qs, err := ParseQuantiles(""); err != nil || qs != nil {
+		t.Errorf("Expected no quantiles, got: %v, %v", qs, err)
+	}
+
+	for _, s := range []string{"p", "p101", "p-1", "p+1", "p1.0001", "p.5", "p50,", "mean", "P50", "p5x"} {
+		if _, err := ParseQuantiles(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestProcessHistograms(t *testing.T) {
+	sample := filepath.Join(samplesDir, "measurements-rounding.txt")
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := ParseQuantiles("p50,p90,p99,median,mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected bytes.Buffer
+	if err := WriteOfficialQuantiles(&expected, readSampleHistograms(t, sample), EncodeOptions{Quantiles: qs}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{Concurrency: 4, ChunkSize: 1000, Histograms: true}
+	for name, process := range map[string]func() (Results, error){
+		"bytes": func() (Results, error) { return ProcessBytes(context.Background(), data, opts) },
+		"reader at": func() (Results, error) {
+			return Process(context.Background(), bytes.NewReader(data), int64(len(data)), opts)
+		},
+		"reader": func() (Results, error) {
+			return ProcessReader(context.Background(), iotest.HalfReader(bytes.NewReader(data)), opts)
+		},
+		"bgzf": func() (Results, error) {
+			compressed := bgzfData(t, data, 500)
+			return ProcessCompressed(context.Background(), bytes.NewReader(compressed), int64(len(compressed)), BGZF, opts)
+		},
+	} {
+		results, err := process()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := WriteOfficialQuantiles(&out, results, EncodeOptions{Quantiles: qs}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected.String() {
+			t.Errorf("Wrong %s output, expected:\n%s\ngot:\n%s", name, expected.String(), out.String())
+		}
+	}
+
+	results, err := ProcessBytes(context.Background(), data, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range results {
+		if s.Histogram != nil {
+			t.Fatalf("Unexpected histogram for %s", name)
+		}
+	}
+}
+
+// readSampleHistograms aggregates a measurements file with histograms
+func readSampleHistograms(t *testing.T, filename string) Results {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	results := Results{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, _ := strings.Cut(scanner.Text(), ";")
+		v, err := strconv.ParseInt(strings.Replace(value, ".", "", 1), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := results[name]
+		if s == nil {
+			s = &Stats{Histogram: new(Histogram)}
+			results[name] = s
+		}
+		s.Add(v)
+		s.Histogram.Add(v)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
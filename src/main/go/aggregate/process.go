@@ -0,0 +1,742 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/swar"
+)
+
+const (
+	// DefaultChunkSize is the number of bytes Process reads per chunk
+	// unless Options.ChunkSize is set.
+	DefaultChunkSize = 64 * 1024 * 1024
+
+	// DefaultStreamChunkSize is the number of bytes ProcessReader reads
+	// per block unless Options.ChunkSize is set.
+	DefaultStreamChunkSize = 4 * 1024 * 1024
+
+	// DefaultMaxStations is the maximum number of stations of a worker
+	// unless Options.MaxStations is set, the table holding them takes
+	// about 400MiB then.
+	DefaultMaxStations = 1 << 20
+
+	// DefaultMaxLineLen is the maximum length of a line in bytes crossing
+	// chunks unless Options.MaxLineLen is set.
+	DefaultMaxLineLen = 1024 * 1024
+
+	// chunkOverflow is the number of bytes read past the end of a chunk to
+	// complete its last line, enough for a 100 byte name and the value.
+	// Longer lines are completed by further reads.
+	chunkOverflow = 128
+
+	// minStreamChunkSize keeps blocks large enough to hold common lines
+	minStreamChunkSize = 2 * chunkOverflow
+)
+
+// Options configures Process and ProcessBytes.
+type Options struct {
+	// Concurrency is the number of chunks processed in parallel,
+	// defaults to runtime.NumCPU().
+	Concurrency int
+
+	// ChunkSize is the number of bytes per chunk. Chunks are extended to
+	// the end of their last line. Process defaults to DefaultChunkSize,
+	// ProcessReader to DefaultStreamChunkSize and ProcessBytes splits the
+	// data evenly across Concurrency chunks.
+	ChunkSize int
+
+	// Histograms counts the measurements of every station in a
+	// Stats.Histogram for quantiles. It costs 8KiB per station and worker.
+	Histograms bool
+
+	// MaxStations bounds the stations in the table of a worker, which grows
+	// with them. More stations are reported as ErrTooManyStations.
+	// Defaults to DefaultMaxStations.
+	MaxStations int
+
+	// MaxLineLen bounds the bytes buffered for a line which does not fit
+	// into a chunk or block including its newline, longer lines are
+	// reported as ErrMalformed. Defaults to DefaultMaxLineLen, ProcessBytes
+	// does not limit lines which are in memory already.
+	MaxLineLen int
+
+	// Strict validates every line and reports the first invalid one as a
+	// *LineError with its offset and line number. The input is read and
+	// validated by a single goroutine, so strict processing is slower.
+	Strict bool
+
+	// OnInvalid is called in strict mode for every invalid line in order,
+	// which is skipped then rather than failing processing.
+	OnInvalid func(*LineError)
+
+	// Hash hashes the station names, defaults to HashWyhash. Seeded hashes
+	// keep processing fast on names crafted to collide.
+	Hash Hash
+
+	// OnTableStats is called after processing with the stats of the table
+	// of every worker which processed any input, in the order of workers.
+	OnTableStats func(TableStats)
+}
+
+func (o Options) concurrency() int {
+	if o.Concurrency > 0 {
+		return o.Concurrency
+	}
+	return runtime.NumCPU()
+}
+
+func (o Options) maxStations() int {
+	if o.MaxStations > 0 {
+		return o.MaxStations
+	}
+	return DefaultMaxStations
+}
+
+func (o Options) maxLineLen() int {
+	if o.MaxLineLen > 0 {
+		return o.MaxLineLen
+	}
+	return DefaultMaxLineLen
+}
+
+// ErrMalformed is returned for input that is not made of name;value lines.
+var ErrMalformed = errors.New("malformed input")
+
+// ErrTooManyStations is returned for input with more than
+// Options.MaxStations stations in the table of a worker.
+var ErrTooManyStations = errors.New("too many stations")
+
+// Process aggregates size bytes of name;value lines read from r.
+// Chunks are read and parsed concurrently, ctx is checked before each chunk.
+func Process(ctx context.Context, r io.ReaderAt, size int64, opts Options) (Results, error) {
+	if opts.Strict {
+		return processStrict(ctx, io.NewSectionReader(r, 0, size), opts)
+	}
+	chunkSize := int64(opts.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	chunkSize = max(min(chunkSize, size), 1)
+	nChunks := int((size + chunkSize - 1) / chunkSize)
+
+	// one byte before the chunk to find the first line start,
+	// the chunk, the overflow and room for a missing final newline
+	bufSize := int(chunkSize) + chunkOverflow + 2
+	bufs := sync.Pool{New: func() any { return make([]byte, bufSize) }}
+
+	return run(ctx, opts, func(ctx context.Context, jobs chan<- job) error {
+		for i := 0; i < nChunks; i++ {
+			offset := int64(i) * chunkSize
+			j := func(t *table) error {
+				buf := bufs.Get().([]byte)
+				defer bufs.Put(buf)
+
+				data, err := readChunk(r, buf, offset, min(chunkSize, size-offset), size, opts.maxLineLen())
+				if err != nil {
+					return err
+				}
+				if err := t.process(data); err != nil {
+					return fmt.Errorf("%w in chunk at offset %d", err, offset)
+				}
+				return nil
+			}
+			if err := send(ctx, jobs, j); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readChunk reads the lines which start in [offset, offset+n) into buf. A last
+// line longer than the overflow of buf is read into a new buffer.
+func readChunk(r io.ReaderAt, buf []byte, offset, n, size int64, maxLineLen int) ([]byte, error) {
+	readOffset := offset
+	if offset > 0 {
+		readOffset-- // to see whether offset starts a line
+	}
+	toRead := min(int64(len(buf)-1), size-readOffset)
+
+	read, err := r.ReadAt(buf[:toRead], readOffset)
+	if err != nil && !(err == io.EOF && int64(read) == toRead) {
+		return nil, err
+	}
+
+	start := 0
+	if offset > 0 {
+		nlPos := bytes.IndexByte(buf[:read], '\n')
+		if nlPos == -1 {
+			// the chunk is part of a line started in a previous chunk
+			return nil, nil
+		}
+		start = nlPos + 1
+	}
+
+	// first byte after the chunk
+	chunkEnd := int(offset - readOffset + n)
+	if start >= chunkEnd {
+		// the chunk is part of a line started in a previous chunk
+		return nil, nil
+	}
+
+	end := read
+	if chunkEnd < read {
+		nlPos := bytes.IndexByte(buf[chunkEnd-1:read], '\n')
+		if nlPos != -1 {
+			end = chunkEnd + nlPos
+		} else if readOffset+int64(read) < size {
+			return readLongLine(r, buf[start:read], readOffset+int64(read), size, maxLineLen)
+		}
+	}
+
+	if buf[end-1] != '\n' {
+		// last line of the input
+		buf[end] = '\n'
+		end++
+	}
+	return buf[start:end], nil
+}
+
+// readLongLine returns a copy of the lines in data followed by the rest of
+// its last line, which is read from r at offset up to a newline or size.
+func readLongLine(r io.ReaderAt, data []byte, offset, size int64, maxLineLen int) ([]byte, error) {
+	lineStart := bytes.LastIndexByte(data, '\n') + 1
+	lineOffset := offset - int64(len(data)-lineStart)
+	tooLong := fmt.Errorf("%w: line longer than %d bytes at offset %d", ErrMalformed, maxLineLen, lineOffset)
+
+	data = bytes.Clone(data)
+	for offset < size {
+		if len(data)-lineStart >= maxLineLen {
+			return nil, tooLong
+		}
+
+		// read as much as the line has so far, doubling it
+		n := int(min(int64(max(len(data)-lineStart, chunkOverflow)), size-offset))
+		data = slices.Grow(data, n+1)
+		more := data[len(data) : len(data)+n]
+		read, err := r.ReadAt(more, offset)
+		if err != nil && !(err == io.EOF && read == n) {
+			return nil, err
+		}
+		offset += int64(read)
+
+		if nlPos := bytes.IndexByte(more, '\n'); nlPos != -1 {
+			data = data[:len(data)+nlPos+1]
+			if len(data)-lineStart > maxLineLen {
+				return nil, tooLong
+			}
+			return data, nil
+		}
+		data = data[:len(data)+n]
+	}
+
+	// last line of the input
+	if len(data)-lineStart+1 > maxLineLen {
+		return nil, tooLong
+	}
+	return append(data, '\n'), nil
+}
+
+// ProcessBytes aggregates name;value lines in data.
+// Chunks of data are parsed concurrently, ctx is checked before each chunk.
+func ProcessBytes(ctx context.Context, data []byte, opts Options) (Results, error) {
+	if opts.Strict {
+		return processStrict(ctx, bytes.NewReader(data), opts)
+	}
+	concurrency := opts.concurrency()
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(data) / concurrency
+	}
+	if chunkSize == 0 {
+		chunkSize = len(data)
+	}
+
+	chunks := make([]int, 0, len(data)/max(chunkSize, 1)+1)
+	offset := 0
+	for offset < len(data) {
+		offset += chunkSize
+		if offset >= len(data) {
+			chunks = append(chunks, len(data))
+			break
+		}
+
+		nlPos := bytes.IndexByte(data[offset:], '\n')
+		if nlPos == -1 {
+			chunks = append(chunks, len(data))
+			break
+		} else {
+			offset += nlPos + 1
+			chunks = append(chunks, offset)
+		}
+	}
+
+	return run(ctx, opts, func(ctx context.Context, jobs chan<- job) error {
+		start := 0
+		for _, end := range chunks {
+			chunk, offset := data[start:end], start
+			start = end
+
+			j := func(t *table) error {
+				// the parser expects every line to end with a newline
+				var last []byte
+				if len(chunk) > 0 && chunk[len(chunk)-1] != '\n' {
+					nlPos := bytes.LastIndexByte(chunk, '\n')
+					last = append(chunk[nlPos+1:len(chunk):len(chunk)], '\n')
+					chunk = chunk[:nlPos+1]
+				}
+
+				if err := t.process(chunk); err != nil {
+					return fmt.Errorf("%w in chunk at offset %d", err, offset)
+				}
+				if err := t.process(last); err != nil {
+					return fmt.Errorf("%w in chunk at offset %d", err, offset)
+				}
+				return nil
+			}
+			if err := send(ctx, jobs, j); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ProcessReader aggregates name;value lines read from r, which does not need
+// to be seekable, e.g. a pipe. A single goroutine reads blocks of
+// Options.ChunkSize bytes and cuts them after their last newline, the rest
+// of the line is carried over to the next block, blocks grow to hold lines
+// longer than a block. Blocks are parsed concurrently, ctx is checked before
+// each block.
+func ProcessReader(ctx context.Context, r io.Reader, opts Options) (Results, error) {
+	if opts.Strict {
+		return processStrict(ctx, r, opts)
+	}
+	concurrency := opts.concurrency()
+
+	blockSize := opts.ChunkSize
+	if blockSize <= 0 {
+		blockSize = DefaultStreamChunkSize
+	}
+	blockSize = max(blockSize, minStreamChunkSize)
+	maxLineLen := opts.maxLineLen()
+
+	return run(ctx, opts, func(ctx context.Context, jobs chan<- job) error {
+		// blocks being parsed or read, one more than workers to read ahead
+		free := make(chan []byte, concurrency+1)
+		for i := 0; i < cap(free); i++ {
+			free <- nil // allocated on first use
+		}
+
+		var carry []byte // start of the last line of the previous block
+		offset := int64(0)
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			// blocks grow to twice the carried line, for long lines
+			size := max(blockSize, 2*len(carry))
+			if len(buf) < size+1 {
+				buf = make([]byte, size+1)
+			}
+
+			n := copy(buf, carry)
+			read, err := readFull(r, buf[n:size])
+			n += read
+			eof := err == io.EOF
+			if err != nil && !eof {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+
+			block := buf[:n]
+			if eof {
+				if block[n-1] != '\n' {
+					// last line of the input, there is room for the newline
+					block = append(block, '\n')
+				}
+				carry = nil
+			} else {
+				nlPos := bytes.LastIndexByte(block, '\n')
+				if nlPos == -1 {
+					// the block is part of a single line
+					if len(block) >= maxLineLen {
+						return fmt.Errorf("%w: line longer than %d bytes at offset %d", ErrMalformed, maxLineLen, offset)
+					}
+					carry = append(carry[:0], block...)
+					free <- buf
+					continue
+				}
+				carry = append(carry[:0], block[nlPos+1:]...)
+				block = block[:nlPos+1]
+			}
+
+			blockOffset := offset
+			offset += int64(len(block))
+			j := func(t *table) error {
+				defer func() { free <- buf }()
+
+				if err := t.process(block); err != nil {
+					return fmt.Errorf("%w in block at offset %d", err, blockOffset)
+				}
+				return nil
+			}
+			if err := send(ctx, jobs, j); err != nil {
+				return err
+			}
+			if eof {
+				return nil
+			}
+		}
+	})
+}
+
+// readFull reads into buf until it is full or r fails. Unlike io.ReadFull it
+// keeps io.ErrUnexpectedEOF of r, e.g. for a truncated compressed stream,
+// apart from a short read at the end of the input.
+func readFull(r io.Reader, buf []byte) (n int, err error) {
+	for n < len(buf) && err == nil {
+		var read int
+		read, err = r.Read(buf[n:])
+		n += read
+	}
+	return n, err
+}
+
+// job processes a chunk into the table of the worker running it
+type job func(t *table) error
+
+// send sends j unless ctx is done
+func send(ctx context.Context, jobs chan<- job, j job) error {
+	select {
+	case jobs <- j:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run processes the jobs sent by produce using Options.Concurrency workers
+// with a table each, and merges the tables of all workers. It stops at the
+// first error of produce or a job.
+func run(ctx context.Context, opts Options, produce func(ctx context.Context, jobs chan<- job) error) (Results, error) {
+	concurrency := opts.concurrency()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		if err := produce(ctx, jobs); err != nil {
+			fail(err)
+		}
+	}()
+
+	results := make([]*table, concurrency)
+
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func(w int) {
+			defer wg.Done()
+
+			var t *table // allocated on first job
+			for j := range jobs {
+				if t == nil {
+					t = newTable(opts)
+				}
+				err := ctx.Err()
+				if err == nil {
+					err = j(t)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+			results[w] = t
+		}(w)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	measurements := make(Results)
+	for w, t := range results {
+		if t == nil {
+			continue
+		}
+		if opts.OnTableStats != nil {
+			opts.OnTableStats(t.stats(fmt.Sprintf("worker %d", w)))
+		}
+		measurements.Merge(t.results())
+	}
+	return measurements, nil
+}
+
+// Use a linear probe lookup table which grows with the stations
+const (
+	// use power of 2 for fast modulo calculation,
+	// larger than max number of keys of the challenge which is 10_000
+	initialEntries = 1 << 14
+
+	// maximum load of the entries before they double, as a fraction of 4
+	maxLoad = 3
+
+	// longer names are kept outside of the entries
+	maxEntryNameLen = 128
+)
+
+type entry struct {
+	m     Stats
+	hash  uint64
+	vlen  int
+	value [maxEntryNameLen]byte // use power of 2 > 100 for alignment
+}
+
+// table accumulates the stats of all chunks processed by a worker. Names
+// longer than maxEntryNameLen are kept in the long map.
+type table struct {
+	entries     []entry
+	mask        uint64 // len(entries) - 1
+	long        map[string]*Stats
+	count       int
+	growAt      int // count at which the entries double
+	maxStations int
+	histograms  bool
+	hasher      Hasher
+}
+
+// newTable returns an empty table with the histograms, station limit and hash
+// of opts
+func newTable(opts Options) *table {
+	return &table{
+		entries:     make([]entry, initialEntries),
+		mask:        initialEntries - 1,
+		growAt:      initialEntries * maxLoad / 4,
+		maxStations: opts.maxStations(),
+		histograms:  opts.Histograms,
+		hasher:      NewHasher(opts.Hash),
+	}
+}
+
+// keep short and inlinable. get returns nil for a new name beyond
+// maxStations.
+func (t *table) get(hash uint64, value []byte) *Stats {
+	i := hash & t.mask
+	entry := &t.entries[i]
+
+	// bytes.Equal could be commented to speedup assuming no hash collisions
+	for entry.vlen > 0 && !(entry.hash == hash && bytes.Equal(entry.value[:entry.vlen], value)) {
+		i = (i + 1) & t.mask
+		entry = &t.entries[i]
+	}
+
+	if entry.vlen == 0 {
+		if entry = t.add(entry, hash, value); entry == nil {
+			return nil
+		}
+	}
+	return &entry.m
+}
+
+// add stores a new name in the free entry found by get, or in a free entry of
+// the grown table once the load gets too high. It returns nil if the table
+// holds maxStations already.
+func (t *table) add(entry *entry, hash uint64, value []byte) *entry {
+	if t.count == t.maxStations {
+		return nil
+	}
+	if t.count >= t.growAt {
+		t.grow()
+		entry = t.free(hash)
+	}
+
+	entry.hash = hash
+	entry.vlen = copy(entry.value[:], value)
+	t.count++
+	if t.histograms {
+		entry.m.Histogram = new(Histogram)
+	}
+	return entry
+}
+
+// grow doubles the entries and moves them by their stored hash
+func (t *table) grow() {
+	old := t.entries
+	t.entries = make([]entry, 2*len(old))
+	t.mask = uint64(len(t.entries) - 1)
+	t.growAt = len(t.entries) * maxLoad / 4
+	for i := range old {
+		if old[i].vlen > 0 {
+			*t.free(old[i].hash) = old[i]
+		}
+	}
+}
+
+// free returns the first free entry probed for hash
+func (t *table) free(hash uint64) *entry {
+	i := hash & t.mask
+	for t.entries[i].vlen > 0 {
+		i = (i + 1) & t.mask
+	}
+	return &t.entries[i]
+}
+
+// getLong is get for names longer than maxEntryNameLen
+func (t *table) getLong(name []byte) *Stats {
+	if s := t.long[string(name)]; s != nil {
+		return s
+	}
+
+	if t.count == t.maxStations {
+		return nil
+	}
+	if t.long == nil {
+		t.long = make(map[string]*Stats)
+	}
+	s := new(Stats)
+	t.long[string(name)] = s
+	t.count++
+	if t.histograms {
+		s.Histogram = new(Histogram)
+	}
+	return s
+}
+
+// process adds all lines of data, every line must end with a newline.
+// Malformed input is reported as ErrMalformed.
+//
+// Lines are scanned a word of 8 bytes at a time, see package swar.
+func (t *table) process(data []byte) error {
+	wy := t.hasher.hash == HashWyhash
+	for len(data) > 0 {
+		// find the semicolon in words of 8 bytes and hash the words of
+		// the name on the way with wyhash, Load reads the tail of data
+		// byte-wise
+		h := t.hasher.key
+		var i, semi int
+		var w uint64
+		for {
+			if i >= len(data) {
+				return ErrMalformed
+			}
+			w = swar.Load(data[i:])
+			if semi = swar.Index(w, ';'); semi < 8 {
+				break
+			}
+			if wy {
+				h = wyword(h, w)
+			}
+			i += 8
+		}
+		idData := data[:i+semi]
+		data = data[i+semi+1:]
+
+		temp, n := swar.ParseNumber(swar.Load(data))
+		if n == 0 || temp < MinTenths || temp > MaxTenths {
+			return ErrMalformed
+		}
+		data = data[n:]
+
+		var s *Stats
+		if len(idData) <= maxEntryNameLen {
+			var hash uint64
+			if wy {
+				hash = wyfinal(h, swar.Prefix(w, semi), len(idData))
+			} else {
+				hash = t.hasher.Sum(idData)
+			}
+			s = t.get(hash, idData)
+		} else {
+			s = t.getLong(idData)
+		}
+		if s == nil {
+			return fmt.Errorf("%w: more than %d", ErrTooManyStations, t.maxStations)
+		}
+		s.Add(temp)
+		if s.Histogram != nil {
+			s.Histogram.Add(temp)
+		}
+	}
+	return nil
+}
+
+// Table accumulates name;value lines incrementally with the parser of
+// Process, e.g. for lines received over the network. A Table holds at most
+// DefaultMaxStations stations. It is not safe for concurrent use.
+type Table struct {
+	t *table
+}
+
+// NewTable returns an empty Table, histograms enables Stats.Histogram.
+func NewTable(histograms bool) *Table {
+	return &Table{newTable(Options{Histograms: histograms})}
+}
+
+// Process adds the lines of data, which must end with a newline. Malformed
+// input is reported as ErrMalformed and new stations beyond
+// DefaultMaxStations as ErrTooManyStations, the lines before the error are
+// added.
+func (t *Table) Process(data []byte) error {
+	return t.t.process(data)
+}
+
+// Len returns the number of stations.
+func (t *Table) Len() int {
+	return t.t.count
+}
+
+// Results returns a copy of the stats of all stations.
+func (t *Table) Results() Results {
+	results := t.t.results()
+	for name, s := range results {
+		c := *s
+		if s.Histogram != nil {
+			h := *s.Histogram
+			c.Histogram = &h
+		}
+		results[name] = &c
+	}
+	return results
+}
+
+func (t *table) results() Results {
+	result := make(Results, t.count)
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.m.Count > 0 {
+			result[string(entry.value[:entry.vlen])] = &entry.m
+		}
+	}
+	for name, s := range t.long {
+		result[name] = s
+	}
+	return result
+}
@@ -0,0 +1,578 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestProcessSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		data, err := os.ReadFile(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, opts := range []Options{
+			{},
+			{Concurrency: 1},
+			{Concurrency: 3, ChunkSize: 1},
+			{Concurrency: 4, ChunkSize: 7},
+			{Concurrency: 2, ChunkSize: 200},
+		} {
+			t.Run(fmt.Sprintf("%s/%+v", filepath.Base(sample), opts), func(t *testing.T) {
+				results, err := ProcessBytes(context.Background(), data, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertOfficial(t, results, string(expected))
+
+				results, err = Process(context.Background(), bytes.NewReader(data), int64(len(data)), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertOfficial(t, results, string(expected))
+
+				results, err = ProcessReader(context.Background(), iotest.HalfReader(bytes.NewReader(data)), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertOfficial(t, results, string(expected))
+			})
+		}
+	}
+}
+
+func TestProcessVariance(t *testing.T) {
+	sample := filepath.Join(samplesDir, "measurements-rounding.txt")
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := readSample(t, sample)
+
+	// partial sums of squares of many chunks must merge exactly
+	for _, opts := range []Options{{Concurrency: 1}, {Concurrency: 4, ChunkSize: 100}} {
+		results, err := ProcessBytes(context.Background(), data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, e := range expected {
+			if s := results[name]; s == nil || *s != *e {
+				t.Errorf("Wrong stats for %s with %+v, expected: %+v, got: %+v", name, opts, e, s)
+			}
+		}
+	}
+}
+
+func TestProcessReaderBlocks(t *testing.T) {
+	var data bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&data, "station%d;%d.%d\n", i%97, i%199-99, i%10)
+	}
+	expected, err := ProcessBytes(context.Background(), data.Bytes(), Options{Concurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := WriteOfficial(&out, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{
+		{Concurrency: 1, ChunkSize: minStreamChunkSize},
+		{Concurrency: 4, ChunkSize: 1000},
+		{Concurrency: 8, ChunkSize: 4096},
+		{Concurrency: 2},
+	} {
+		for _, r := range []io.Reader{
+			bytes.NewReader(data.Bytes()),
+			iotest.OneByteReader(bytes.NewReader(data.Bytes())),
+			iotest.DataErrReader(bytes.NewReader(data.Bytes())),
+		} {
+			results, err := ProcessReader(context.Background(), r, opts)
+			if err != nil {
+				t.Fatalf("Unexpected error for %+v: %v", opts, err)
+			}
+			assertOfficial(t, results, out.String())
+		}
+	}
+}
+
+func TestProcessMissingFinalNewline(t *testing.T) {
+	data := []byte("a;1.0\nb;-2.5\na;3.0")
+	const expected = "{a=1.0/2.0/3.0, b=-2.5/-2.5/-2.5}\n"
+
+	for chunkSize := 0; chunkSize <= len(data); chunkSize++ {
+		opts := Options{Concurrency: 2, ChunkSize: chunkSize}
+
+		results, err := ProcessBytes(context.Background(), data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, expected)
+
+		results, err = Process(context.Background(), bytes.NewReader(data), int64(len(data)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, expected)
+
+		results, err = ProcessReader(context.Background(), bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, expected)
+	}
+
+	if string(data) != "a;1.0\nb;-2.5\na;3.0" {
+		t.Errorf("Input was modified: %q", data)
+	}
+}
+
+func TestProcessLongNames(t *testing.T) {
+	// distinct names sharing the first maxEntryNameLen bytes, names crossing
+	// chunks longer than their overflow and a last line without newline
+	long := strings.Repeat("ä", 50_000)
+	names := []string{
+		long[:100],
+		long[:maxEntryNameLen],
+		long[:maxEntryNameLen] + "b",
+		long[:maxEntryNameLen] + "c",
+		long[:300],
+		"short",
+		long,
+	}
+	expected := make(Results)
+	var data bytes.Buffer
+	for i := range 3 {
+		for j, name := range names {
+			v := int64(i*10 + j)
+			expected.Add(name, v)
+			fmt.Fprintf(&data, "%s;%d.%d\n", name, v/10, v%10)
+		}
+	}
+	data.Truncate(data.Len() - 1)
+	var out bytes.Buffer
+	if err := WriteOfficial(&out, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunkSize := range []int{0, 1, 7, 100, 1000} {
+		opts := Options{Concurrency: 3, ChunkSize: chunkSize, Histograms: true}
+
+		results, err := ProcessBytes(context.Background(), data.Bytes(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, out.String())
+
+		results, err = Process(context.Background(), bytes.NewReader(data.Bytes()), int64(data.Len()), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, out.String())
+
+		results, err = ProcessReader(context.Background(), iotest.HalfReader(bytes.NewReader(data.Bytes())), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOfficial(t, results, out.String())
+		if h := results[long].Histogram; h == nil || h.Count() != 3 {
+			t.Errorf("Wrong histogram of long name: %v", h)
+		}
+
+		for c, compress := range compressors {
+			compressed := compress(t, data.Bytes(), 1000)
+			results, err = ProcessCompressed(context.Background(), bytes.NewReader(compressed), int64(len(compressed)), c, opts)
+			if err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			assertOfficial(t, results, out.String())
+		}
+	}
+}
+
+func TestProcessFloatDrift(t *testing.T) {
+	// measurements whose means are exactly halfway between tenths
+	var data bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		data.WriteString("a;0.1\na;0.2\nb;-0.1\nb;-0.2\nc;12.3\nc;12.4\n")
+	}
+	filename := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// float64 sums drift below the halfway point of a and c, and round
+	// to the wrong tenth unlike the exact integer sums
+	float := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data.Bytes()))
+	for scanner.Scan() {
+		name, value, _ := strings.Cut(scanner.Text(), ";")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		float[name] += v
+	}
+	for name, drifted := range map[string]float64{"a": 0.1, "c": 12.3} {
+		if mean := math.Round(float[name]/2000*10) / 10; mean != drifted {
+			t.Errorf("Expected float64 mean of %s to drift to %v, got: %v", name, drifted, mean)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	results, err := Process(context.Background(), f, int64(data.Len()), Options{ChunkSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOfficial(t, results, "{a=0.1/0.2/0.2, b=-0.2/-0.1/-0.1, c=12.3/12.4/12.4}\n")
+	if s := results["c"]; s.Sum != 247_000 {
+		t.Errorf("Expected exact sum of c, got: %d", s.Sum)
+	}
+}
+
+func TestProcessEmpty(t *testing.T) {
+	results, err := ProcessBytes(context.Background(), nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOfficial(t, results, "{}\n")
+
+	results, err = Process(context.Background(), bytes.NewReader(nil), 0, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOfficial(t, results, "{}\n")
+
+	results, err = ProcessReader(context.Background(), bytes.NewReader(nil), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOfficial(t, results, "{}\n")
+}
+
+// TestProcessWordHash checks that the hashes of names computed from the words
+// scanned by the parser are the hashes of the names, at every alignment of
+// the names to the words.
+func TestProcessWordHash(t *testing.T) {
+	var data []byte
+	for n := 0; n <= maxEntryNameLen+1; n++ {
+		data = fmt.Appendf(data, "%s;%d.0\n", strings.Repeat("x", n), n%10)
+	}
+	for _, hash := range []Hash{HashWyhash, HashMaphash, HashFNV1a} {
+		table := newTable(Options{Hash: hash})
+		if err := table.process(data); err != nil {
+			t.Fatal(err)
+		}
+		if table.count != maxEntryNameLen+2 {
+			t.Errorf("%v: expected %d stations, got: %d", hash, maxEntryNameLen+2, table.count)
+		}
+		for i := range table.entries {
+			e := &table.entries[i]
+			if e.vlen > 0 && e.hash != table.hasher.Sum(e.value[:e.vlen]) {
+				t.Errorf("%v: wrong hash of %q", hash, e.value[:e.vlen])
+			}
+		}
+	}
+}
+
+func TestProcessMalformed(t *testing.T) {
+	for _, data := range []string{
+		"a;1.0\nb;1\n",
+		"a;1.0\nb;\n",
+		"a;1.0\nb",
+		"a;1.0\nb;12\n",
+		"a;1.0\nb;1.23\nc;1.0\n",
+		"a;1.0;\n",
+		"a;9:.9\n",
+		"a;100.0\n",
+	} {
+		if _, err := ProcessBytes(context.Background(), []byte(data), Options{Histograms: true}); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Expected ErrMalformed for %q, got: %v", data, err)
+		}
+		if _, err := Process(context.Background(), strings.NewReader(data), int64(len(data)), Options{}); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Expected ErrMalformed for %q, got: %v", data, err)
+		}
+		if _, err := ProcessReader(context.Background(), strings.NewReader(data), Options{}); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Expected ErrMalformed for %q, got: %v", data, err)
+		}
+	}
+
+	// lines crossing chunks longer than Options.MaxLineLen
+	data := "a;1.0\n" + strings.Repeat("x", 1000) + ";1.0\n"
+	opts := Options{ChunkSize: 10, MaxLineLen: 500}
+	if _, err := Process(context.Background(), strings.NewReader(data), int64(len(data)), opts); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed for long line, got: %v", err)
+	}
+	if _, err := ProcessReader(context.Background(), strings.NewReader(data), opts); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed for long line, got: %v", err)
+	}
+}
+
+func TestProcessTooManyStations(t *testing.T) {
+	var data strings.Builder
+	for i := 0; i <= 100; i++ {
+		fmt.Fprintf(&data, "s%d;1.0\n", i)
+	}
+	if _, err := ProcessBytes(context.Background(), []byte(data.String()), Options{Concurrency: 1, MaxStations: 100}); !errors.Is(err, ErrTooManyStations) {
+		t.Errorf("Expected ErrTooManyStations, got: %v", err)
+	}
+	if _, err := ProcessBytes(context.Background(), []byte(data.String()), Options{Concurrency: 1, MaxStations: 101}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// names kept outside of the entries
+	long := strings.Repeat("x", maxEntryNameLen+1)
+	data.WriteString(long + ";1.0\n")
+	if _, err := ProcessBytes(context.Background(), []byte(data.String()), Options{Concurrency: 1, MaxStations: 101}); !errors.Is(err, ErrTooManyStations) {
+		t.Errorf("Expected ErrTooManyStations for a long name, got: %v", err)
+	}
+}
+
+func TestProcessManyStations(t *testing.T) {
+	// the table grows past its initial entries
+	const stations = 4*initialEntries + 1
+	var data bytes.Buffer
+	expected := make(Results)
+	for i := range 2 * stations {
+		name := fmt.Sprintf("station%d", i%stations)
+		fmt.Fprintf(&data, "%s;%d.0\n", name, i%100)
+		expected.Add(name, int64(i%100*10))
+	}
+	var out bytes.Buffer
+	if err := WriteOfficial(&out, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{{Concurrency: 1}, {Concurrency: 4, Histograms: true}} {
+		results, err := ProcessBytes(context.Background(), data.Bytes(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != stations {
+			t.Errorf("Expected %d stations, got %d", stations, len(results))
+		}
+		assertOfficial(t, results, out.String())
+	}
+}
+
+func TestTable(t *testing.T) {
+	table := NewTable(true)
+	for _, line := range []string{"a;1.0\n", "b;-2.5\nа;3.0\n", "a;-1.0\n"} {
+		if err := table.Process([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.Process([]byte("b;\n")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got: %v", err)
+	}
+	if table.Len() != 3 {
+		t.Errorf("Expected 3 stations, got %d", table.Len())
+	}
+
+	results := table.Results()
+	assertOfficial(t, results, "{a=-1.0/0.0/1.0, b=-2.5/-2.5/-2.5, а=3.0/3.0/3.0}\n")
+
+	// results are copies
+	if err := table.Process([]byte("a;5.0\n")); err != nil {
+		t.Fatal(err)
+	}
+	if s := results["a"]; s.Count != 2 || s.Histogram.Count() != 2 {
+		t.Errorf("Results changed by processing, got count %d", s.Count)
+	}
+
+	table.t.maxStations = 100
+	for i := table.Len(); i < table.t.maxStations; i++ {
+		if err := table.Process([]byte(fmt.Sprintf("s%d;1.0\n", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.Process([]byte("a;1.0\nnew;1.0\n")); !errors.Is(err, ErrTooManyStations) {
+		t.Errorf("Expected ErrTooManyStations, got: %v", err)
+	}
+	if err := table.Process([]byte("a;1.0\n")); err != nil {
+		t.Errorf("Unexpected error for existing station of full table: %v", err)
+	}
+	if s := table.Results()["a"]; s.Count != 5 {
+		t.Errorf("Expected 5 measurements of a, got %d", s.Count)
+	}
+}
+
+func TestProcessReaderError(t *testing.T) {
+	errRead := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("a;1.0\n"), iotest.ErrReader(errRead))
+	if _, err := ProcessReader(context.Background(), r, Options{}); !errors.Is(err, errRead) {
+		t.Errorf("Expected read error, got: %v", err)
+	}
+}
+
+func TestProcessCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	data := []byte("a;1.0\nb;2.0\n")
+	if _, err := ProcessBytes(ctx, data, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if _, err := Process(ctx, bytes.NewReader(data), int64(len(data)), Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if _, err := ProcessReader(ctx, bytes.NewReader(data), Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+// BenchmarkProcessKeys processes a million lines of a few, the maximum of
+// the challenge and many more distinct stations by a single worker.
+func BenchmarkProcessKeys(b *testing.B) {
+	for _, keys := range []int{400, 10_000, 100_000} {
+		rnd := rand.New(rand.NewSource(1))
+		var data bytes.Buffer
+		for i := 0; i < 1_000_000; i++ {
+			fmt.Fprintf(&data, "station%d;%d.%d\n", rnd.Intn(keys), rnd.Intn(199)-99, rnd.Intn(10))
+		}
+
+		b.Run(fmt.Sprintf("keys=%d", keys), func(b *testing.B) {
+			b.SetBytes(int64(data.Len()))
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessBytes(context.Background(), data.Bytes(), Options{Concurrency: 1}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// processBytewise is table.process scanning one byte at a time as it did
+// before package swar, the baseline of BenchmarkTableProcess. It assumes
+// valid input.
+func processBytewise(t *table, data []byte) error {
+	for len(data) > 0 {
+		semi := 0
+		for semi < len(data) && data[semi] != ';' {
+			semi++
+		}
+		if semi == len(data) {
+			return ErrMalformed
+		}
+		name := data[:semi]
+		data = data[semi+1:]
+
+		negative := len(data) > 0 && data[0] == '-'
+		if negative {
+			data = data[1:]
+		}
+		var temp int64
+		n := 0
+		for ; n < len(data) && data[n] != '\n'; n++ {
+			if c := data[n]; c != '.' {
+				temp = temp*10 + int64(c-'0')
+			}
+		}
+		if n == len(data) {
+			return ErrMalformed
+		}
+		data = data[n+1:]
+		if negative {
+			temp = -temp
+		}
+
+		var s *Stats
+		if len(name) <= maxEntryNameLen {
+			s = t.get(t.hasher.Sum(name), name)
+		} else {
+			s = t.getLong(name)
+		}
+		if s == nil {
+			return ErrTooManyStations
+		}
+		s.Add(temp)
+		if s.Histogram != nil {
+			s.Histogram.Add(temp)
+		}
+	}
+	return nil
+}
+
+func TestProcessBytewise(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, bytewise := newTable(Options{}), newTable(Options{})
+	if err := words.process(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := processBytewise(bytewise, data); err != nil {
+		t.Fatal(err)
+	}
+	var expected bytes.Buffer
+	if err := WriteOfficial(&expected, words.results()); err != nil {
+		t.Fatal(err)
+	}
+	assertOfficial(t, bytewise.results(), expected.String())
+}
+
+// BenchmarkTableProcess scans the same lines as BenchmarkProcessKeys a word
+// and a byte at a time.
+func BenchmarkTableProcess(b *testing.B) {
+	for _, keys := range []int{400, 10_000} {
+		rnd := rand.New(rand.NewSource(1))
+		var data bytes.Buffer
+		for i := 0; i < 1_000_000; i++ {
+			fmt.Fprintf(&data, "station%d;%d.%d\n", rnd.Intn(keys), rnd.Intn(199)-99, rnd.Intn(10))
+		}
+
+		for _, scan := range []struct {
+			name    string
+			process func(*table, []byte) error
+		}{{"words", (*table).process}, {"bytes", processBytewise}} {
+			b.Run(fmt.Sprintf("keys=%d/scan=%s", keys, scan.name), func(b *testing.B) {
+				b.SetBytes(int64(data.Len()))
+				for i := 0; i < b.N; i++ {
+					if err := scan.process(newTable(Options{}), data.Bytes()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func assertOfficial(t *testing.T, results Results, expected string) {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := WriteOfficial(&out, results); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
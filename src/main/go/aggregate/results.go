@@ -0,0 +1,53 @@
+package aggregate
+
+import "sort"
+
+// Results maps station names to their stats.
+type Results map[string]*Stats
+
+// Station is a named entry of Results.
+type Station struct {
+	Name string
+	*Stats
+}
+
+// Add adds a measurement in tenths of a degree for name.
+func (r Results) Add(name string, v int64) {
+	s := r[name]
+	if s == nil {
+		s = &Stats{}
+		r[name] = s
+	}
+	s.Add(v)
+}
+
+// Merge adds all stats of o to r.
+// Stats of names missing in r are moved over, so o must not be used afterwards.
+func (r Results) Merge(o Results) {
+	for name, os := range o {
+		if s := r[name]; s != nil {
+			s.Merge(os)
+		} else {
+			r[name] = os
+		}
+	}
+}
+
+// Names returns the station names in ascending byte order.
+func (r Results) Names() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sorted returns the stations in ascending byte order of their names.
+func (r Results) Sorted() []Station {
+	stations := make([]Station, 0, len(r))
+	for _, name := range r.Names() {
+		stations = append(stations, Station{name, r[name]})
+	}
+	return stations
+}
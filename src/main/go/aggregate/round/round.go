@@ -0,0 +1,92 @@
+// Package round rounds exact quotients of integers, such as the mean of
+// temperatures in tenths of a degree, to integers.
+//
+// Rounding the integer quotient directly avoids the floating point error of
+// rounding sum/count computed as a float, which makes implementations
+// disagree on values close to ties.
+package round
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mode is a rounding mode. The zero value is HalfUp.
+type Mode int
+
+const (
+	// HalfUp rounds to the closest integer with ties towards positive
+	// infinity like java's Math.round, which computes the official
+	// results. Unlike java's RoundingMode.HALF_UP, -2.5 rounds to -2.
+	HalfUp Mode = iota
+
+	// HalfEven rounds to the closest integer with ties to the even one
+	// like java's RoundingMode.HALF_EVEN, e.g. 2.5 to 2 and 3.5 to 4.
+	HalfEven
+
+	// Truncate rounds towards zero like java's RoundingMode.DOWN.
+	Truncate
+)
+
+var names = [...]string{
+	HalfUp:   "half-up",
+	HalfEven: "half-even",
+	Truncate: "truncate",
+}
+
+// String returns the name of m accepted by Parse.
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(names) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return names[m]
+}
+
+// Names returns the names of all modes accepted by Parse.
+func Names() []string {
+	return names[:]
+}
+
+// Parse returns the mode with the given name, see Names.
+func Parse(name string) (Mode, error) {
+	for m, n := range names {
+		if n == name {
+			return Mode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rounding mode %q, must be one of: %s", name, strings.Join(Names(), ", "))
+}
+
+// Set sets m to the mode with the given name, so a *Mode is a flag.Value.
+func (m *Mode) Set(name string) error {
+	mode, err := Parse(name)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// Div returns n/d rounded to an integer in mode m, d must be positive.
+// It does not overflow for any n.
+func (m Mode) Div(n, d int64) int64 {
+	if m == Truncate {
+		return n / d // Go division truncates
+	}
+
+	// floor(n/d) with the remainder 0 <= r < d
+	q, r := n/d, n%d
+	if r < 0 {
+		q--
+		r += d
+	}
+
+	// compare the fraction r/d with 1/2 as r with d-r, 2*r may overflow
+	switch {
+	case r > d-r:
+		q++
+	case r == d-r && (m == HalfUp || q%2 != 0):
+		q++
+	}
+	return q
+}
@@ -0,0 +1,107 @@
+package round
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestDiv(t *testing.T) {
+	// java's Math.round(x), new BigDecimal(x).setScale(0, HALF_EVEN) and
+	// setScale(0, DOWN) for x = n/d
+	for _, tc := range []struct {
+		n, d                       int64
+		halfUp, halfEven, truncate int64
+	}{
+		{0, 1, 0, 0, 0},
+		{5, 2, 3, 2, 2},
+		{7, 2, 4, 4, 3},
+		{-5, 2, -2, -2, -2},
+		{-7, 2, -3, -4, -3},
+		{1, 2, 1, 0, 0},
+		{-1, 2, 0, 0, 0},
+		{-3, 2, -1, -2, -1},
+		{1, 3, 0, 0, 0},
+		{2, 3, 1, 1, 0},
+		{-2, 3, -1, -1, 0},
+		{-1, 3, 0, 0, 0},
+		{249, 10, 25, 25, 24},
+		{-251, 10, -25, -25, -25},
+		{math.MaxInt64, 2, math.MaxInt64/2 + 1, math.MaxInt64/2 + 1, math.MaxInt64 / 2},
+		{math.MinInt64, 3, math.MinInt64/3 - 1, math.MinInt64/3 - 1, math.MinInt64 / 3},
+		{math.MinInt64 + 1, math.MaxInt64, -1, -1, -1},
+		{math.MaxInt64, math.MaxInt64, 1, 1, 1},
+	} {
+		for m, expected := range map[Mode]int64{HalfUp: tc.halfUp, HalfEven: tc.halfEven, Truncate: tc.truncate} {
+			if got := m.Div(tc.n, tc.d); got != expected {
+				t.Errorf("%v of %d/%d, expected: %d, got: %d", m, tc.n, tc.d, expected, got)
+			}
+		}
+	}
+}
+
+// TestDivExhaustive compares Div with rounding a big.Rat for every sum of up
+// to maxCount measurements from -99.9 to 99.9 in tenths
+func TestDivExhaustive(t *testing.T) {
+	const minTenths, maxTenths = -999, 999
+	maxCount := int64(30)
+	if testing.Short() {
+		maxCount = 5
+	}
+
+	half := big.NewRat(1, 2)
+	var x, frac big.Rat
+	var floor, rem big.Int
+	for count := int64(1); count <= maxCount; count++ {
+		d := big.NewInt(count)
+		for sum := count * minTenths; sum <= count*maxTenths; sum++ {
+			x.SetFrac(big.NewInt(sum), d)
+
+			// floor and fraction of x, Int.DivMod is euclidean
+			floor.DivMod(x.Num(), x.Denom(), &rem)
+			frac.SetFrac(&rem, x.Denom())
+			cmp := frac.Cmp(half)
+
+			f := floor.Int64()
+			expected := map[Mode]int64{HalfUp: f, HalfEven: f, Truncate: f}
+			if cmp >= 0 {
+				expected[HalfUp]++
+			}
+			if cmp > 0 || cmp == 0 && f%2 != 0 {
+				expected[HalfEven]++
+			}
+			if x.Sign() < 0 && rem.Sign() != 0 {
+				expected[Truncate]++
+			}
+
+			for m, e := range expected {
+				if got := m.Div(sum, count); got != e {
+					t.Fatalf("%v of %d/%d, expected: %d, got: %d", m, sum, count, e, got)
+				}
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, name := range Names() {
+		m, err := Parse(name)
+		if err != nil || m.String() != name {
+			t.Errorf("Parse(%q) = %v, %v", name, m, err)
+		}
+	}
+	if _, err := Parse("up"); err == nil {
+		t.Errorf("Expected error for unknown mode")
+	}
+
+	var m Mode
+	if err := m.Set("truncate"); err != nil || m != Truncate {
+		t.Errorf("Set(truncate) = %v, %v", m, err)
+	}
+	if err := m.Set("up"); err == nil || m != Truncate {
+		t.Errorf("Expected error and unchanged mode for unknown mode, got: %v", m)
+	}
+	if s := Mode(-1).String(); s != "Mode(-1)" {
+		t.Errorf("Wrong name of invalid mode: %s", s)
+	}
+}
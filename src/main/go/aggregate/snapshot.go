@@ -0,0 +1,211 @@
+package aggregate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Snapshots hold Results losslessly, so the results of runs over different
+// inputs can be merged later. The format is
+//
+//	magic     "1BRCSNAP"
+//	version   uint16, little endian
+//	stations  uvarint number of stations, followed by each station sorted by name:
+//	  name        uvarint length and bytes
+//	  count       uvarint
+//	  min, max, sum, sum of squares  varint
+//	  histogram   uvarint number of non-empty buckets, 0 without histogram,
+//	              followed by uvarint bucket index delta and count pairs
+//	checksum  uint32 CRC-32C of all preceding bytes, little endian
+//
+// Bucket index deltas are relative to the previous bucket, the first one to
+// the bucket of MinTenths.
+const (
+	snapshotMagic   = "1BRCSNAP"
+	snapshotVersion = 1
+
+	// upper bound of names to not allocate arbitrary amounts for corrupt input
+	maxSnapshotNameLen = 1 << 16
+)
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInvalidSnapshot is returned for data which is not a valid snapshot.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// WriteSnapshot writes r as a snapshot.
+func WriteSnapshot(w io.Writer, r Results) error {
+	crc := crc32.New(snapshotTable)
+	out := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	buf := append([]byte(snapshotMagic), 0, 0)
+	binary.LittleEndian.PutUint16(buf[len(snapshotMagic):], snapshotVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(r)))
+	out.Write(buf)
+
+	for _, s := range r.Sorted() {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(s.Name)))
+		buf = append(buf, s.Name...)
+		buf = binary.AppendUvarint(buf, uint64(s.Count))
+		buf = binary.AppendVarint(buf, s.Min)
+		buf = binary.AppendVarint(buf, s.Max)
+		buf = binary.AppendVarint(buf, s.Sum)
+		buf = binary.AppendVarint(buf, s.SumSquares)
+		buf = appendHistogram(buf, s.Histogram)
+		out.Write(buf)
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+func appendHistogram(b []byte, h *Histogram) []byte {
+	if h == nil {
+		return append(b, 0)
+	}
+	buckets := 0
+	for _, n := range h {
+		if n > 0 {
+			buckets++
+		}
+	}
+	b = binary.AppendUvarint(b, uint64(buckets))
+
+	prev := 0
+	for i, n := range h {
+		if n > 0 {
+			b = binary.AppendUvarint(b, uint64(i-prev))
+			b = binary.AppendUvarint(b, uint64(n))
+			prev = i
+		}
+	}
+	return b
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot. Snapshots of other
+// versions and corrupt data are reported as ErrInvalidSnapshot.
+func ReadSnapshot(r io.Reader) (Results, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := len(snapshotMagic) + 2
+	if len(data) < header+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidSnapshot)
+	}
+	if v := binary.LittleEndian.Uint16(data[len(snapshotMagic):]); v != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, v)
+	}
+	body, checksum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, snapshotTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	d := snapshotDecoder{data: body[header:]}
+	stations := d.uvarint(uint64(len(d.data)))
+	results := make(Results, stations)
+	for i := uint64(0); i < stations && d.err == nil; i++ {
+		name := string(d.bytes(int(d.uvarint(maxSnapshotNameLen))))
+		s := &Stats{
+			Count:      int64(d.uvarint(math.MaxInt64)),
+			Min:        d.varint(),
+			Max:        d.varint(),
+			Sum:        d.varint(),
+			SumSquares: d.varint(),
+			Histogram:  d.histogram(),
+		}
+		if d.err != nil {
+			break
+		}
+		if _, ok := results[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate station %q", ErrInvalidSnapshot, name)
+		}
+		if s.Histogram != nil && s.Histogram.Count() != s.Count {
+			return nil, fmt.Errorf("%w: histogram of %q does not match count", ErrInvalidSnapshot, name)
+		}
+		results[name] = s
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, d.err)
+	}
+	return results, nil
+}
+
+// snapshotDecoder decodes the values of a snapshot, the first error is kept
+// and makes all further values zero.
+type snapshotDecoder struct {
+	data []byte
+	err  error
+}
+
+// uvarint decodes a uvarint which must not be larger than limit
+func (d *snapshotDecoder) uvarint(limit uint64) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 || v > limit {
+		d.err = errors.New("invalid length or count")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *snapshotDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errors.New("invalid number")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *snapshotDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *snapshotDecoder) histogram() *Histogram {
+	buckets := d.uvarint(histogramSize)
+	if buckets == 0 || d.err != nil {
+		return nil
+	}
+
+	h := new(Histogram)
+	i := uint64(0)
+	for b := uint64(0); b < buckets && d.err == nil; b++ {
+		i += d.uvarint(histogramSize)
+		n := d.uvarint(math.MaxUint32)
+		if i >= histogramSize || n == 0 || (b > 0 && h[i] != 0) {
+			d.err = errors.New("invalid histogram")
+			break
+		}
+		h[i] = uint32(n)
+	}
+	return h
+}
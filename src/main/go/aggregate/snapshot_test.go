@@ -0,0 +1,136 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for name, results := range map[string]Results{
+		"empty":      {},
+		"samples":    readSample(t, filepath.Join(samplesDir, "measurements-10000-unique-keys.txt")),
+		"utf8":       readSample(t, filepath.Join(samplesDir, "measurements-complex-utf8.txt")),
+		"histograms": readSampleHistograms(t, filepath.Join(samplesDir, "measurements-rounding.txt")),
+		"extremes": {
+			"":                        &Stats{Min: MinTenths, Max: MaxTenths, Sum: -1 << 62, SumSquares: 1<<63 - 1, Count: 1<<63 - 1},
+			strings.Repeat("x", 1000): &Stats{Min: -1, Max: 1, Count: 2},
+		},
+	} {
+		var buf bytes.Buffer
+		if err := WriteSnapshot(&buf, results); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadSnapshot(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, results) {
+			t.Errorf("Wrong %s results after round trip", name)
+		}
+	}
+}
+
+func TestSnapshotMerge(t *testing.T) {
+	sample := filepath.Join(samplesDir, "measurements-rounding.txt")
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := readSampleHistograms(t, sample)
+
+	// snapshots of parts of the input, e.g. daily files
+	merged := Results{}
+	for len(data) > 0 {
+		end := len(data)
+		if end > 5000 {
+			end = 5000 + bytes.IndexByte(data[5000:], '\n') + 1
+		}
+		part, err := ProcessBytes(context.Background(), data[:end], Options{Histograms: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = data[end:]
+
+		var buf bytes.Buffer
+		if err := WriteSnapshot(&buf, part); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := ReadSnapshot(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged.Merge(snapshot)
+	}
+
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Merged snapshots differ from the results of the whole input")
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	results := Results{}
+	results.Add("Hamburg", 120)
+	results.Add("Bulawayo", -89)
+	results["Hamburg"].Histogram = new(Histogram)
+	results["Hamburg"].Histogram.Add(120)
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	// every corrupted byte is detected
+	for i := range valid {
+		corrupt := bytes.Clone(valid)
+		corrupt[i] ^= 0x10
+		if _, err := ReadSnapshot(bytes.NewReader(corrupt)); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("Expected invalid snapshot error for byte %d, got: %v", i, err)
+		}
+	}
+	for n := range valid {
+		if _, err := ReadSnapshot(bytes.NewReader(valid[:n])); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("Expected invalid snapshot error for %d bytes, got: %v", n, err)
+		}
+	}
+
+	// a checksum does not make a future version readable
+	future := bytes.Clone(valid[:len(valid)-4])
+	binary.LittleEndian.PutUint16(future[len(snapshotMagic):], snapshotVersion+1)
+	future = binary.LittleEndian.AppendUint32(future, crc32.Checksum(future, snapshotTable))
+	if _, err := ReadSnapshot(bytes.NewReader(future)); err == nil || !strings.Contains(err.Error(), "unsupported version 2") {
+		t.Errorf("Expected unsupported version error, got: %v", err)
+	}
+
+	// valid checksums of invalid contents
+	for name, body := range map[string][]byte{
+		"trailing data": append(bytes.Clone(valid[:len(valid)-4]), 0),
+		"duplicate":     snapshotBody(2, "a", "a"),
+		"truncated":     snapshotBody(3, "a", "b"),
+	} {
+		data := binary.LittleEndian.AppendUint32(body, crc32.Checksum(body, snapshotTable))
+		if _, err := ReadSnapshot(bytes.NewReader(data)); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("Expected invalid snapshot error for %s, got: %v", name, err)
+		}
+	}
+}
+
+// snapshotBody encodes stations with one measurement each without checksum
+func snapshotBody(stations int, names ...string) []byte {
+	b := append([]byte(snapshotMagic), snapshotVersion, 0)
+	b = binary.AppendUvarint(b, uint64(stations))
+	for _, name := range names {
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+		b = append(b, 1, 2, 2, 2, 8, 0) // count, min, max, sum, sum of squares, histogram
+	}
+	return b
+}
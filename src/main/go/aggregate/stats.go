@@ -0,0 +1,125 @@
+// Package aggregate accumulates, merges and formats per station temperature
+// statistics of the one billion row challenge.
+//
+// Temperatures are fixed-point integers in tenths of a degree, e.g. -12.3 is
+// -123, so sums are exact and results do not depend on the order in which
+// chunks are merged.
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
+
+// MaxCount is the number of measurements up to which the sums of Stats are
+// exact. Every measurement adds at most MaxTenths^2 to SumSquares, so the
+// sums can only overflow beyond about 9e12 measurements.
+const MaxCount = math.MaxInt64 / (MaxTenths * MaxTenths)
+
+// ErrOverflow is returned for writing Stats of more than MaxCount
+// measurements, whose sums may have overflowed.
+var ErrOverflow = fmt.Errorf("more than %d measurements, sums may overflow", MaxCount)
+
+// Stats accumulates the measurements of a single station.
+// The zero value is empty and ready to use.
+type Stats struct {
+	Min, Max, Sum, Count int64
+
+	// SumSquares is the exact sum of squared tenths for the variance, see
+	// MaxCount.
+	SumSquares int64
+
+	// Histogram is nil unless quantiles are requested, callers of Add
+	// count measurements in it themselves.
+	Histogram *Histogram
+}
+
+// Add adds a measurement in tenths of a degree.
+// It is small enough to be inlined into parse loops and does not allocate.
+func (s *Stats) Add(v int64) {
+	if s.Count == 0 {
+		s.Min = v
+		s.Max = v
+	} else {
+		s.Min = min(s.Min, v)
+		s.Max = max(s.Max, v)
+	}
+	s.Sum += v
+	s.SumSquares += v * v
+	s.Count++
+}
+
+// Merge adds all measurements accumulated by o.
+// The Histogram of o is taken over if s is empty, so o must not be used
+// afterwards. Otherwise histograms are merged if both have one, and dropped if
+// only one has, as it would not count all measurements.
+func (s *Stats) Merge(o *Stats) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		*s = *o
+		return
+	}
+	s.Min = min(s.Min, o.Min)
+	s.Max = max(s.Max, o.Max)
+	s.Sum += o.Sum
+	s.SumSquares += o.SumSquares
+	s.Count += o.Count
+	if s.Histogram != nil && o.Histogram != nil {
+		s.Histogram.Merge(o.Histogram)
+	} else {
+		s.Histogram = nil
+	}
+}
+
+// Overflows reports whether s has more than MaxCount measurements, so its
+// sums may have overflowed. Checking the count rather than every addition
+// keeps Add and Merge fast.
+func (s *Stats) Overflows() bool {
+	return s.Count > MaxCount
+}
+
+// Mean returns the mean in tenths of a degree rounded to the closest integer,
+// with ties rounding to positive infinity like java's Math.round.
+// It is computed exactly on the integers, so there is no floating point error
+// and no -0. Mean of empty Stats is 0.
+func (s *Stats) Mean() int64 {
+	return s.MeanRounded(round.HalfUp)
+}
+
+// MeanRounded returns the mean in tenths of a degree rounded in mode m.
+// Mean of empty Stats is 0.
+func (s *Stats) MeanRounded(m round.Mode) int64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return m.Div(s.Sum, s.Count)
+}
+
+// Variance returns the population variance in squared degrees. It is
+// computed exactly from the integer sums, sum(v^2)/n - (sum(v)/n)^2, and
+// rounded once to the closest float64. Variance of empty Stats is 0.
+func (s *Stats) Variance() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	// (n*sum(v^2) - sum(v)^2) / (n^2 * 100) for v in tenths,
+	// the products do not fit into int64
+	n, sum := big.NewInt(s.Count), big.NewInt(s.Sum)
+	num := new(big.Int).Mul(n, big.NewInt(s.SumSquares))
+	num.Sub(num, sum.Mul(sum, sum))
+	den := n.Mul(n, n)
+	den.Mul(den, big.NewInt(100))
+
+	v, _ := new(big.Rat).SetFrac(num, den).Float64()
+	return v
+}
+
+// Stddev returns the population standard deviation in degrees.
+func (s *Stats) Stddev() float64 {
+	return math.Sqrt(s.Variance())
+}
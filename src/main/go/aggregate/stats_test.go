@@ -0,0 +1,263 @@
+package aggregate
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+)
+
+func TestStatsAdd(t *testing.T) {
+	var s Stats
+	for _, v := range []int64{5, -12, 999, 0, -999} {
+		s.Add(v)
+	}
+	if expected := (Stats{Min: -999, Max: 999, Sum: -7, Count: 5, SumSquares: 1_996_171}); s != expected {
+		t.Errorf("Wrong stats, expected: %+v, got: %+v", expected, s)
+	}
+}
+
+func TestStatsAddDoesNotAllocate(t *testing.T) {
+	var s Stats
+	if allocs := testing.AllocsPerRun(100, func() { s.Add(-123) }); allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestStatsMerge(t *testing.T) {
+	values := []int64{1, -5, 30, 2, 2, -7, 100}
+
+	var expected Stats
+	for _, v := range values {
+		expected.Add(v)
+	}
+
+	for split := 0; split <= len(values); split++ {
+		var a, b Stats
+		for _, v := range values[:split] {
+			a.Add(v)
+		}
+		for _, v := range values[split:] {
+			b.Add(v)
+		}
+		a.Merge(&b)
+		if a != expected {
+			t.Errorf("Wrong merge at %d, expected: %+v, got: %+v", split, expected, a)
+		}
+	}
+}
+
+func TestStatsMergeHistograms(t *testing.T) {
+	stats := func(histogram bool, values ...int64) *Stats {
+		s := new(Stats)
+		if histogram {
+			s.Histogram = new(Histogram)
+		}
+		for _, v := range values {
+			s.Add(v)
+			if histogram {
+				s.Histogram.Add(v)
+			}
+		}
+		return s
+	}
+
+	for _, tc := range []struct {
+		s, o      *Stats
+		histogram bool
+	}{
+		{s: stats(true, 1, 2), o: stats(true, 3), histogram: true},
+		{s: stats(false), o: stats(true, 3), histogram: true},
+		{s: stats(true, 1, 2), o: stats(false, 3)},
+		{s: stats(false, 1, 2), o: stats(true, 3)},
+	} {
+		tc.s.Merge(tc.o)
+		if tc.histogram != (tc.s.Histogram != nil) {
+			t.Errorf("Expected histogram %v after merge, got: %+v", tc.histogram, tc.s.Histogram)
+		} else if tc.histogram && tc.s.Histogram.Count() != tc.s.Count {
+			t.Errorf("Expected histogram of %d measurements, got: %d", tc.s.Count, tc.s.Histogram.Count())
+		}
+	}
+}
+
+func TestStatsMean(t *testing.T) {
+	for _, tc := range []struct {
+		sum, count int64
+		expected   string
+	}{
+		{sum: 0, count: 0, expected: "0.0"},
+		{sum: 0, count: 1, expected: "0.0"},
+		{sum: -15, count: 10, expected: "-0.1"},   // -0.15
+		{sum: -10, count: 10, expected: "-0.1"},   // -0.1
+		{sum: -7, count: 10, expected: "-0.1"},    // -0.07
+		{sum: -5, count: 10, expected: "0.0"},     // -0.05 is not -0.0
+		{sum: -3, count: 10, expected: "0.0"},     // -0.03
+		{sum: 3, count: 10, expected: "0.0"},      // 0.03
+		{sum: 5, count: 10, expected: "0.1"},      // 0.05
+		{sum: 7, count: 10, expected: "0.1"},      // 0.07
+		{sum: 15, count: 10, expected: "0.2"},     // 0.15
+		{sum: 7, count: 2, expected: "0.4"},       // 0.35
+		{sum: -7, count: 2, expected: "-0.3"},     // -0.35
+		{sum: -1, count: 3, expected: "0.0"},      // -0.0333...
+		{sum: -2, count: 3, expected: "-0.1"},     // -0.0666...
+		{sum: 1, count: 3, expected: "0.0"},       // 0.0333...
+		{sum: 999, count: 3, expected: "33.3"},    // truncating division agrees here
+		{sum: -1999, count: 2, expected: "-99.9"}, // -99.95
+		{sum: 1999, count: 2, expected: "100.0"},  // 99.95
+		{sum: -1006, count: 10, expected: "-10.1"},
+		{sum: -9_990_000_000, count: 100_000_000, expected: "-10.0"}, // -9.99
+		{sum: 9_990_000_000, count: 1_000_000_000, expected: "1.0"},
+	} {
+		s := Stats{Sum: tc.sum, Count: tc.count}
+		if got := string(AppendTenths(nil, s.Mean())); got != tc.expected {
+			t.Errorf("Wrong mean of %d/%d, expected: %s, got: %s", tc.sum, tc.count, tc.expected, got)
+		}
+	}
+}
+
+func TestStatsMeanRounded(t *testing.T) {
+	r := Results{
+		"a": {Sum: -15, Count: 10},  // -0.15
+		"b": {Sum: -25, Count: 10},  // -0.25
+		"c": {Sum: 25, Count: 10},   // 0.25
+		"d": {Sum: -7, Count: 10},   // -0.07
+		"e": {Sum: 1999, Count: 2},  // 99.95
+		"f": {Sum: -1, Count: 3},    // -0.0333...
+		"g": {Sum: 1994, Count: 20}, // 9.97
+	}
+	for m, expected := range map[round.Mode]string{
+		round.HalfUp:   "{a=0.0/-0.1/0.0, b=0.0/-0.2/0.0, c=0.0/0.3/0.0, d=0.0/-0.1/0.0, e=0.0/100.0/0.0, f=0.0/0.0/0.0, g=0.0/10.0/0.0}\n",
+		round.HalfEven: "{a=0.0/-0.2/0.0, b=0.0/-0.2/0.0, c=0.0/0.2/0.0, d=0.0/-0.1/0.0, e=0.0/100.0/0.0, f=0.0/0.0/0.0, g=0.0/10.0/0.0}\n",
+		round.Truncate: "{a=0.0/-0.1/0.0, b=0.0/-0.2/0.0, c=0.0/0.2/0.0, d=0.0/0.0/0.0, e=0.0/99.9/0.0, f=0.0/0.0/0.0, g=0.0/9.9/0.0}\n",
+	} {
+		var out bytes.Buffer
+		if err := WriteOfficialQuantiles(&out, r, EncodeOptions{Rounding: m}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected {
+			t.Errorf("Wrong %v output, expected: %s, got: %s", m, expected, out.String())
+		}
+	}
+
+	for _, s := range r {
+		if s.Mean() != s.MeanRounded(round.HalfUp) {
+			t.Errorf("Mean of %+v is not rounded half up", s)
+		}
+	}
+}
+
+var statsSink Stats
+
+func BenchmarkStatsAdd(b *testing.B) {
+	var s Stats
+	for i := 0; i < b.N; i++ {
+		s.Add(int64(i%1999 - 999))
+	}
+	statsSink = s
+}
+
+// twoPassVariance computes the population variance in squared degrees of
+// values in tenths with the mean subtracted first
+func twoPassVariance(values []int64) float64 {
+	mean := 0.0
+	for _, v := range values {
+		mean += float64(v) / 10
+	}
+	mean /= float64(len(values))
+
+	variance := 0.0
+	for _, v := range values {
+		d := float64(v)/10 - mean
+		variance += d * d
+	}
+	return variance / float64(len(values))
+}
+
+func TestStatsVariance(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 500; i++ {
+		values := make([]int64, 1+rnd.Intn(1000))
+		center, spread := int64(rnd.Intn(1999)-999), 1+rnd.Intn(20)
+		for j := range values {
+			values[j] = max(-999, min(999, center+int64(rnd.Intn(spread))))
+		}
+
+		// merge partial stats of random parts in random order
+		parts := make([]Stats, 1+rnd.Intn(8))
+		for _, v := range values {
+			parts[rnd.Intn(len(parts))].Add(v)
+		}
+		var s Stats
+		for _, j := range rnd.Perm(len(parts)) {
+			s.Merge(&parts[j])
+		}
+
+		expected := twoPassVariance(values)
+		if got := s.Variance(); math.Abs(got-expected) > 1e-9*max(1, expected) {
+			t.Errorf("Wrong variance of %v, expected: %v, got: %v", values, expected, got)
+		}
+		if got := s.Stddev(); math.Abs(got-math.Sqrt(expected)) > 1e-9*max(1, expected) {
+			t.Errorf("Wrong stddev of %v, expected: %v, got: %v", values, math.Sqrt(expected), got)
+		}
+	}
+}
+
+func TestStatsVarianceExact(t *testing.T) {
+	for _, tc := range []struct {
+		values   []int64
+		expected float64
+	}{
+		{nil, 0},
+		{[]int64{123}, 0},
+		{[]int64{999, 999, 999}, 0},
+		{[]int64{-10, 10}, 1},
+		{[]int64{20, 40, 40, 40, 50, 50, 70, 90}, 4},
+	} {
+		var s Stats
+		for _, v := range tc.values {
+			s.Add(v)
+		}
+		if got := s.Variance(); got != tc.expected {
+			t.Errorf("Wrong variance of %v, expected: %v, got: %v", tc.values, tc.expected, got)
+		}
+	}
+
+	// a billion measurements far from zero overflow int64 products
+	s := Stats{Count: 1_000_000_000, Sum: 999 * 1_000_000_000, SumSquares: 999 * 999 * 1_000_000_000, Min: 999, Max: 999}
+	if got := s.Variance(); got != 0 {
+		t.Errorf("Expected no variance of constant measurements, got: %v", got)
+	}
+}
+
+func TestStatsOverflow(t *testing.T) {
+	// MaxCount extreme measurements fit, checked by the compiler
+	const sumSquares = MaxTenths * MaxTenths * MaxCount
+	s := Stats{Min: -MaxTenths, Max: MaxTenths, Sum: -MaxTenths * MaxCount, SumSquares: sumSquares, Count: MaxCount}
+	if s.Overflows() {
+		t.Errorf("Unexpected overflow of %d measurements", s.Count)
+	}
+	r := Results{"a": &Stats{Min: 1, Max: 1, Sum: 1, SumSquares: 1, Count: 1}, "b": &s}
+	if err := WriteOfficial(io.Discard, r); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	s.Merge(&Stats{Min: MinTenths, Max: MinTenths, Sum: MinTenths, SumSquares: MinTenths * MinTenths, Count: 1})
+	if !s.Overflows() {
+		t.Errorf("Expected overflow of %d measurements", s.Count)
+	}
+	for name, encode := range Encoders {
+		if name == "snapshot" {
+			// holds the sums as they are
+			continue
+		}
+		var out bytes.Buffer
+		if err := encode(&out, r, EncodeOptions{}); !errors.Is(err, ErrOverflow) || out.Len() > 0 {
+			t.Errorf("Expected ErrOverflow and no %s output, got: %v %q", name, err, out.String())
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package aggregate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	// MaxNameLen is the maximum length of station names in bytes accepted
+	// in strict mode.
+	MaxNameLen = 100
+
+	// strictBufferSize bounds the length of lines validated in strict mode,
+	// longer lines are reported without looking at their content
+	strictBufferSize = 64 * 1024
+)
+
+// LineError is an invalid line found in strict mode. It matches ErrMalformed.
+type LineError struct {
+	Offset int64 // of the first byte of the line
+	Line   int64 // starting at 1
+	Reason string
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d at offset %d: %s", e.Line, e.Offset, e.Reason)
+}
+
+func (e *LineError) Unwrap() error {
+	return ErrMalformed
+}
+
+// processStrict validates the lines read from r one by one and passes the
+// valid ones to the workers in blocks of Options.ChunkSize bytes.
+func processStrict(ctx context.Context, r io.Reader, opts Options) (Results, error) {
+	concurrency := opts.concurrency()
+
+	blockSize := opts.ChunkSize
+	if blockSize <= 0 {
+		blockSize = DefaultStreamChunkSize
+	}
+	blockSize = max(blockSize, minStreamChunkSize)
+
+	return run(ctx, opts, func(ctx context.Context, jobs chan<- job) error {
+		// blocks being parsed or filled, one more than workers to read ahead
+		free := make(chan []byte, concurrency+1)
+		for i := 0; i < cap(free); i++ {
+			free <- nil // allocated on first use
+		}
+		next := func() ([]byte, error) {
+			select {
+			case buf := <-free:
+				if buf == nil {
+					buf = make([]byte, 0, blockSize)
+				}
+				return buf[:0], nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		flush := func(block []byte) error {
+			return send(ctx, jobs, func(t *table) error {
+				defer func() { free <- block }()
+				return t.process(block)
+			})
+		}
+
+		block, err := next()
+		if err != nil {
+			return err
+		}
+
+		br := bufio.NewReaderSize(r, strictBufferSize)
+		var offset, lineNo int64
+		for {
+			line, err := br.ReadSlice('\n')
+			n := int64(len(line))
+			long := false
+			for err == bufio.ErrBufferFull {
+				long = true
+				line, err = br.ReadSlice('\n')
+				n += int64(len(line))
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			lineNo++
+
+			line = bytes.TrimSuffix(line, []byte{'\n'})
+			var reason string
+			if long {
+				reason = fmt.Sprintf("line longer than %d bytes", strictBufferSize)
+			} else {
+				reason = validateLine(line)
+			}
+
+			if reason != "" {
+				e := &LineError{Offset: offset, Line: lineNo, Reason: reason}
+				if opts.OnInvalid == nil {
+					return e
+				}
+				opts.OnInvalid(e)
+			} else {
+				if len(block)+len(line)+1 > blockSize {
+					if err := flush(block); err != nil {
+						return err
+					}
+					var nextErr error
+					if block, nextErr = next(); nextErr != nil {
+						return nextErr
+					}
+				}
+				block = append(block, line...)
+				block = append(block, '\n')
+			}
+
+			offset += n
+			if err == io.EOF {
+				break
+			}
+		}
+		if len(block) > 0 {
+			return flush(block)
+		}
+		return nil
+	})
+}
+
+// validateLine returns why the line without its newline is not a name;value
+// line with a value from -99.9 to 99.9, or "" if it is valid
+func validateLine(line []byte) string {
+	semi := bytes.IndexByte(line, ';')
+	switch {
+	case len(line) == 0:
+		return "empty line"
+	case semi < 0:
+		return "missing ';' separator"
+	case semi == 0:
+		return "empty name"
+	case semi > MaxNameLen:
+		return fmt.Sprintf("name longer than %d bytes", MaxNameLen)
+	}
+
+	value := line[semi+1:]
+	v, ok := parseTenths(value)
+	switch {
+	case !ok:
+		return fmt.Sprintf("invalid number %.20q", value)
+	case v < MinTenths || v > MaxTenths:
+		return fmt.Sprintf("value %.20s out of range", value)
+	}
+	return ""
+}
+
+// parseTenths parses a number with a single decimal as in -123.4 into tenths,
+// values beyond MaxTenths are capped at MaxTenths+1. Leading zeros are only
+// accepted up to two integer digits as in 01.2, as Process parses them.
+func parseTenths(v []byte) (int64, bool) {
+	negative := len(v) > 0 && v[0] == '-'
+	if negative {
+		v = v[1:]
+	}
+	n := len(v)
+	if n < 3 || v[n-2] != '.' || !isDigit(v[n-1]) || n > 4 && v[0] == '0' {
+		return 0, false
+	}
+
+	var tenths int64
+	for _, b := range v[:n-2] {
+		if !isDigit(b) {
+			return 0, false
+		}
+		if tenths <= MaxTenths {
+			tenths = tenths*10 + int64(b-'0')
+		}
+	}
+	tenths = min(tenths*10+int64(v[n-1]-'0'), MaxTenths+1)
+
+	if negative {
+		return -tenths, true
+	}
+	return tenths, true
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
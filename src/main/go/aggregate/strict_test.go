@@ -0,0 +1,145 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateLine(t *testing.T) {
+	for line, expected := range map[string]string{
+		"a;1.0":                           "",
+		"a;-1.0":                          "",
+		"a;12.3":                          "",
+		"a;-99.9":                         "",
+		"a;05.0":                          "",
+		"a;-0.0":                          "",
+		"São Paulo;99.9":                  "",
+		"a;b;1.0":                         `invalid number "b;1.0"`,
+		strings.Repeat("x", 100) + ";1.0": "",
+		strings.Repeat("x", 101) + ";1.0": "name longer than 100 bytes",
+		"":                                "empty line",
+		"a 1.0":                           "missing ';' separator",
+		";1.0":                            "empty name",
+		"a;":                              `invalid number ""`,
+		"a;1":                             `invalid number "1"`,
+		"a;1.":                            `invalid number "1."`,
+		"a;.5":                            `invalid number ".5"`,
+		"a;1.23":                          `invalid number "1.23"`,
+		"a;+1.0":                          `invalid number "+1.0"`,
+		"a;1x.0":                          `invalid number "1x.0"`,
+		"a;1.0\r":                         `invalid number "1.0\r"`,
+		"a;--1.0":                         `invalid number "--1.0"`,
+		"a;001.0":                         `invalid number "001.0"`,
+		"a;100.0":                         "value 100.0 out of range",
+		"a;-100.0":                        "value -100.0 out of range",
+		"a;123456789012345678901234567.8": "value 12345678901234567890 out of range",
+	} {
+		if reason := validateLine([]byte(line)); reason != expected {
+			t.Errorf("Wrong reason for %q, expected: %q, got: %q", line, expected, reason)
+		}
+	}
+}
+
+func TestProcessStrict(t *testing.T) {
+	const data = "a;1.0\n" +
+		"b;1\n" +
+		"\n" +
+		"a;3.0\n" +
+		"c;1000.0\n" +
+		";1.0\n" +
+		"b;-2.5\n" +
+		"d"
+	expected := []*LineError{
+		{Offset: 6, Line: 2, Reason: `invalid number "1"`},
+		{Offset: 10, Line: 3, Reason: "empty line"},
+		{Offset: 17, Line: 5, Reason: "value 1000.0 out of range"},
+		{Offset: 26, Line: 6, Reason: "empty name"},
+		{Offset: 38, Line: 8, Reason: "missing ';' separator"},
+	}
+	const valid = "{a=1.0/2.0/3.0, b=-2.5/-2.5/-2.5}\n"
+
+	process := map[string]func(opts Options) (Results, error){
+		"ProcessBytes": func(opts Options) (Results, error) {
+			return ProcessBytes(context.Background(), []byte(data), opts)
+		},
+		"Process": func(opts Options) (Results, error) {
+			return Process(context.Background(), strings.NewReader(data), int64(len(data)), opts)
+		},
+		"ProcessReader": func(opts Options) (Results, error) {
+			return ProcessReader(context.Background(), strings.NewReader(data), opts)
+		},
+		"ProcessCompressed": func(opts Options) (Results, error) {
+			bgzf := bgzfData(t, []byte(data), 10)
+			return ProcessCompressed(context.Background(), bytes.NewReader(bgzf), int64(len(bgzf)), BGZF, opts)
+		},
+	}
+	for name, process := range process {
+		_, err := process(Options{Strict: true})
+		var lineErr *LineError
+		if !errors.As(err, &lineErr) || !reflect.DeepEqual(lineErr, expected[0]) || !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: expected %v, got: %v", name, expected[0], err)
+		}
+
+		// skipping invalid lines, in blocks of a single line
+		for _, chunkSize := range []int{0, 1} {
+			var invalid []*LineError
+			results, err := process(Options{Strict: true, ChunkSize: chunkSize, OnInvalid: func(e *LineError) {
+				invalid = append(invalid, e)
+			}})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			assertOfficial(t, results, valid)
+			if !reflect.DeepEqual(invalid, expected) {
+				t.Errorf("%s: wrong invalid lines, expected: %v, got: %v", name, expected, invalid)
+			}
+		}
+	}
+}
+
+func TestProcessStrictLongLine(t *testing.T) {
+	data := "a;1.0\n" + strings.Repeat("x", 3*strictBufferSize) + "\na;3.0\n"
+
+	var invalid []*LineError
+	results, err := ProcessReader(context.Background(), strings.NewReader(data), Options{Strict: true, OnInvalid: func(e *LineError) {
+		invalid = append(invalid, e)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOfficial(t, results, "{a=1.0/2.0/3.0}\n")
+	expected := []*LineError{{Offset: 6, Line: 2, Reason: "line longer than 65536 bytes"}}
+	if !reflect.DeepEqual(invalid, expected) {
+		t.Errorf("Wrong invalid lines, expected: %v, got: %v", expected, invalid)
+	}
+}
+
+func TestProcessStrictSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		data, err := os.ReadFile(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, err := ProcessBytes(context.Background(), data, Options{Strict: true, ChunkSize: 1000})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", sample, err)
+		}
+		assertOfficial(t, results, string(expected))
+	}
+}
@@ -0,0 +1,74 @@
+// Package swar finds bytes and parses temperatures in 8 bytes at a time, SIMD
+// within a register, to scan name;value lines without a branch per byte.
+//
+// Words hold 8 bytes of the input in little-endian order, so the first byte
+// is the lowest byte of the word.
+package swar
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	ones  = 0x0101010101010101
+	highs = 0x8080808080808080
+)
+
+// Load returns the first 8 bytes of p as a word. Fewer bytes, e.g. at the
+// end of a mapping, are read one at a time and padded with zeros.
+func Load(p []byte) uint64 {
+	if len(p) >= 8 {
+		return binary.LittleEndian.Uint64(p)
+	}
+	return loadTail(p)
+}
+
+// loadTail is the byte-wise Load of less than 8 bytes, out of line to keep
+// Load inlinable
+func loadTail(p []byte) uint64 {
+	var w uint64
+	for i := len(p) - 1; i >= 0; i-- {
+		w = w<<8 | uint64(p[i])
+	}
+	return w
+}
+
+// Index returns the index of the first byte c in w, or 8 if there is none.
+func Index(w uint64, c byte) int {
+	x := w ^ ones*uint64(c)
+	// the lowest high bit set marks the first zero byte of x, borrows
+	// only mark bytes above it
+	return bits.TrailingZeros64((x-ones)&^x&highs) >> 3
+}
+
+// Prefix returns the first n bytes of w and zeros in place of the others, n
+// must be at most 8.
+func Prefix(w uint64, n int) uint64 {
+	return w & (1<<(8*uint(n)) - 1)
+}
+
+// ParseNumber parses the temperature matching "^-?[0-9]{1,2}[.][0-9]\n" at
+// the start of w and returns it in tenths, e.g. -12.3 as -123, with the
+// number of bytes up to and including the newline. The length is 0 if the
+// sign, the decimal point and the newline are not where the pattern puts
+// them, the digits are not checked.
+func ParseNumber(w uint64) (tenths int64, n int) {
+	// digits have bit 4 set unlike '-' and '.', the bit of the decimal
+	// point is found in the bytes 1 to 3
+	dot := bits.TrailingZeros64(^w & 0x10101000)
+	if byte(w>>uint(dot+12)) != '\n' {
+		return 0, 0
+	}
+
+	// -1 for a minus sign, which is masked out of the digits
+	sign := int64(^w<<59) >> 63
+	if dot == 28 && sign == 0 {
+		return 0, 0 // three digits before the point, as in 123.4
+	}
+	// move the digits to the bytes 1, 2 and 4 and add them up as
+	// 100*d1 + 10*d2 + d4 in the bits from 32 with a single multiplication
+	digits := (w &^ (uint64(sign) & 0xff) << uint(28-dot)) & 0x0f000f0f00
+	abs := int64(digits * (100<<24 + 10<<16 + 1) >> 32 & 0x3ff)
+	return (abs ^ sign) - sign, dot>>3 + 3
+}
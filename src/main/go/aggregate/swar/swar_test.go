@@ -0,0 +1,139 @@
+package swar
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	data := []byte("abcdefghij")
+	for n := 0; n <= len(data); n++ {
+		var padded [8]byte
+		copy(padded[:], data[:n])
+		if w, expected := Load(data[:n]), Load(padded[:]); w != expected {
+			t.Errorf("Load of %d bytes = %#x, expected: %#x", n, w, expected)
+		}
+	}
+	if w := Load([]byte("a;")); w != ';'<<8|'a' {
+		t.Errorf("Wrong byte order: %#x", w)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	// every position, with bytes around that borrow in the subtraction
+	for _, fill := range []byte{0, 'a', ';' - 1, ';' + 1, 0x80, 0xff} {
+		for i := 0; i <= 8; i++ {
+			p := bytes.Repeat([]byte{fill}, 8)
+			if i < 8 {
+				p[i] = ';'
+				for j := i + 1; j < 8; j++ {
+					p[j] = ';' // only the first counts
+				}
+			}
+			if got := Index(Load(p), ';'); got != i {
+				t.Errorf("Index(%q) = %d, expected: %d", p, got, i)
+			}
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	w := Load([]byte("abcdefgh"))
+	for n := 0; n <= 8; n++ {
+		if got, expected := Prefix(w, n), Load([]byte("abcdefgh")[:n]); got != expected {
+			t.Errorf("Prefix(%d) = %#x, expected: %#x", n, got, expected)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	// every temperature with the rest of the word taken by the next line
+	for tenths := -999; tenths <= 999; tenths++ {
+		s := fmt.Sprintf("%d.%d", abs(tenths)/10, abs(tenths)%10)
+		if tenths < 0 {
+			s = "-" + s
+		}
+		line := s + "\nxyz;1"
+		got, n := ParseNumber(Load([]byte(line)))
+		if got != int64(tenths) || n != len(s)+1 {
+			t.Errorf("ParseNumber(%q) = %d, %d, expected: %d, %d", line, got, n, tenths, len(s)+1)
+		}
+	}
+
+	for _, line := range []string{"", "1\n", "12\n", "1.23\n", "123.4\n", "100.0\n", "b;\n", "1.0", "-1.0;"} {
+		if _, n := ParseNumber(Load([]byte(line))); n != 0 {
+			t.Errorf("ParseNumber(%q) = %d bytes, expected invalid", line, n)
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+var scanSink int64
+
+// BenchmarkScan splits the lines of a sample into names and temperatures a
+// byte at a time, and with the words of this package. The byte loop does not
+// use bytes.IndexByte, which is vectorized rather than a byte-wise baseline.
+func BenchmarkScan(b *testing.B) {
+	data, err := os.ReadFile("../../../../test/resources/samples/measurements-10000-unique-keys.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("scan=bytes", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			var sum int64
+			for p := data; len(p) > 0; {
+				semi := 0
+				for p[semi] != ';' {
+					semi++
+				}
+				nl := semi + 1
+				for p[nl] != '\n' {
+					nl++
+				}
+				var tenths int64
+				for _, c := range p[semi+1 : nl] {
+					if c >= '0' {
+						tenths = tenths*10 + int64(c-'0')
+					}
+				}
+				if p[semi+1] == '-' {
+					tenths = -tenths
+				}
+				sum += int64(semi) + tenths
+				p = p[nl+1:]
+			}
+			scanSink = sum
+		}
+	})
+
+	b.Run("scan=swar", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			var sum int64
+			for p := data; len(p) > 0; {
+				semi := 0
+				for {
+					n := Index(Load(p[semi:]), ';')
+					semi += n
+					if n < 8 {
+						break
+					}
+				}
+				tenths, n := ParseNumber(Load(p[semi+1:]))
+				sum += int64(semi) + tenths
+				p = p[semi+1+n:]
+			}
+			scanSink = sum
+		}
+	})
+}
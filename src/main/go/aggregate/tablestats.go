@@ -0,0 +1,82 @@
+package aggregate
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// TableStats describes how the stations of a hash table are laid out, to
+// choose table sizes and hashes from data.
+//
+// The probe length of a name is the number of slots compared to find it,
+// 1 if it is in the slot of its hash. Names which are not are collisions.
+type TableStats struct {
+	// Table names the table, e.g. "worker 0"
+	Table string `json:"table"`
+
+	// Stations is the number of distinct names
+	Stations int `json:"stations"`
+
+	// Entries is the number of slots, 0 for tables whose slots are
+	// unknown such as Go maps. Occupied slots hold names, names which do
+	// not fit into a slot are counted by Stations only.
+	Entries  int `json:"entries"`
+	Occupied int `json:"occupied"`
+
+	LoadFactor float64 `json:"load_factor"`
+	MaxProbe   int     `json:"max_probe"`
+	AvgProbe   float64 `json:"avg_probe"`
+	Collisions int     `json:"collisions"`
+
+	probes int // sum of the probe lengths
+}
+
+// AddSlot counts an occupied slot whose name is found after probing probe
+// slots, Entries must be set before.
+func (s *TableStats) AddSlot(probe int) {
+	s.Occupied++
+	s.LoadFactor = float64(s.Occupied) / float64(s.Entries)
+	s.MaxProbe = max(s.MaxProbe, probe)
+	s.probes += probe
+	s.AvgProbe = float64(s.probes) / float64(s.Occupied)
+	if probe > 1 {
+		s.Collisions++
+	}
+}
+
+// stats returns the stats of t
+func (t *table) stats(name string) TableStats {
+	s := TableStats{Table: name, Stations: t.count, Entries: len(t.entries)}
+	for i := range t.entries {
+		if e := &t.entries[i]; e.vlen > 0 {
+			s.AddSlot(int((uint64(i)-e.hash)&t.mask) + 1)
+		}
+	}
+	return s
+}
+
+// WriteTableStats writes a line per table of stats.
+func WriteTableStats(w io.Writer, stats []TableStats) error {
+	out := bufio.NewWriter(w)
+	for _, s := range stats {
+		if s.Entries == 0 {
+			fmt.Fprintf(out, "%s: %d stations\n", s.Table, s.Stations)
+			continue
+		}
+		fmt.Fprintf(out, "%s: %d stations, %d of %d slots occupied (load %.3f), probes max %d avg %.3f, %d collisions\n",
+			s.Table, s.Stations, s.Occupied, s.Entries, s.LoadFactor, s.MaxProbe, s.AvgProbe, s.Collisions)
+	}
+	return out.Flush()
+}
+
+// WriteTableStatsJSON writes stats as a JSON array of objects.
+func WriteTableStatsJSON(w io.Writer, stats []TableStats) error {
+	if stats == nil {
+		stats = []TableStats{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
@@ -0,0 +1,104 @@
+package aggregate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableStats(t *testing.T) {
+	table := newTable(Options{})
+	mask := uint64(initialEntries - 1)
+	for _, e := range []struct {
+		hash uint64
+		name string
+	}{
+		{0, "a"},    // slot 0
+		{0, "b"},    // slot 1
+		{1, "c"},    // slot 2
+		{mask, "d"}, // last slot
+		{mask, "e"}, // wraps around to slot 3
+	} {
+		table.get(e.hash, []byte(e.name))
+	}
+	table.getLong([]byte(strings.Repeat("x", maxEntryNameLen+1)))
+
+	expected := TableStats{
+		Table:      "test",
+		Stations:   6,
+		Entries:    initialEntries,
+		Occupied:   5,
+		LoadFactor: 5.0 / initialEntries,
+		MaxProbe:   5,
+		AvgProbe:   (1 + 2 + 2 + 1 + 5) / 5.0,
+		Collisions: 3,
+		probes:     11,
+	}
+	if s := table.stats("test"); s != expected {
+		t.Errorf("Wrong stats, expected: %+v, got: %+v", expected, s)
+	}
+}
+
+func TestProcessTableStats(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats []TableStats
+	results, err := ProcessBytes(context.Background(), data, Options{Concurrency: 1, OnTableStats: func(s TableStats) {
+		stats = append(stats, s)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Expected stats of 1 table, got: %+v", stats)
+	}
+	s := stats[0]
+	if s.Table != "worker 0" || s.Stations != len(results) || s.Occupied != s.Stations || s.Entries < s.Stations*4/3 {
+		t.Errorf("Wrong stats for %d stations: %+v", len(results), s)
+	}
+	if s.AvgProbe < 1 || float64(s.MaxProbe) < s.AvgProbe || s.Collisions >= s.Stations {
+		t.Errorf("Wrong probes: %+v", s)
+	}
+}
+
+func TestWriteTableStats(t *testing.T) {
+	stats := []TableStats{
+		{Table: "worker 0", Stations: 3, Entries: 8, Occupied: 3, LoadFactor: 0.375, MaxProbe: 2, AvgProbe: 4.0 / 3, Collisions: 1},
+		{Table: "chunk 1", Stations: 2},
+	}
+
+	var out bytes.Buffer
+	if err := WriteTableStats(&out, stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := "worker 0: 3 stations, 3 of 8 slots occupied (load 0.375), probes max 2 avg 1.333, 1 collisions\n" +
+		"chunk 1: 2 stations\n"
+	if out.String() != expected {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := WriteTableStatsJSON(&out, stats); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []TableStats
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, stats) {
+		t.Errorf("Wrong JSON, expected: %+v, got: %s", stats, out.String())
+	}
+
+	out.Reset()
+	if err := WriteTableStatsJSON(&out, nil); err != nil || out.String() != "[]\n" {
+		t.Errorf("Wrong empty JSON: %q, %v", out.String(), err)
+	}
+}
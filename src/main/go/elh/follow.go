@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+// followFile parses the measurements file like tail -f: after the existing
+// lines it keeps parsing appended lines until ctx is done. emit is called with
+// the stats after the existing lines, every interval (if non-zero), on
+// emitSignals and before returning. A trailing line is held back until its
+// newline is written. A truncated file is parsed again from the start.
+func followFile(ctx context.Context, measurementsPath string, numParsers, parseChunkSize int, interval, pollInterval time.Duration, emit func(aggregate.Results)) {
+	f, err := os.Open(measurementsPath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to open %s file: %w", measurementsPath, err))
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+	}
+	compression, err := aggregate.DetectCompression(f, info.Size())
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+	}
+	if compression != aggregate.Uncompressed {
+		log.Fatal(fmt.Errorf("can not follow %v compressed %s file", compression, measurementsPath))
+	}
+
+	// subscribe before parsing to not miss changes in between
+	changes := watch(ctx, measurementsPath, pollInterval)
+	emitCh := make(chan os.Signal, 1)
+	signal.Notify(emitCh, emitSignals...)
+	defer signal.Stop(emitCh)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	stats := make(aggregate.Results, maxNameNum)
+	var offset int64 // end of the last parsed line
+	parseAppended := func() {
+		info, err := f.Stat()
+		if err != nil {
+			log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+		}
+		size := info.Size()
+		if size < offset {
+			log.Printf("%s file truncated, parsing it again", measurementsPath)
+			stats = make(aggregate.Results, maxNameNum)
+			offset = 0
+		}
+
+		end := lineEnd(f, offset, size)
+		if end > offset {
+			stats.Merge(parseSection(io.NewSectionReader(f, offset, end-offset), numParsers, parseChunkSize, nil))
+			offset = end
+		}
+	}
+
+	parseAppended()
+	emit(stats)
+	for {
+		select {
+		case <-ctx.Done():
+			parseAppended()
+			emit(stats)
+			return
+		case <-changes:
+			parseAppended()
+		case <-tick:
+			emit(stats)
+		case <-emitCh:
+			emit(stats)
+		}
+	}
+}
+
+// lineEnd returns the offset after the last newline of f between start and
+// end, or start if there is none.
+func lineEnd(f io.ReaderAt, start, end int64) int64 {
+	buf := make([]byte, 4096)
+	for end > start {
+		n := min(int64(len(buf)), end-start)
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			// truncated in the meantime, noticed by the next change
+			return start
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return end - n + int64(i) + 1
+		}
+		end -= n
+	}
+	return start
+}
+
+// pollChanges notifies about possible changes every interval, for systems
+// without file change notifications
+func pollChanges(ctx context.Context, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go poll(ctx, interval, changes)
+	return changes
+}
+
+func poll(ctx context.Context, interval time.Duration, changes chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify(changes)
+		}
+	}
+}
+
+// notify sends to changes unless a notification is pending already
+func notify(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
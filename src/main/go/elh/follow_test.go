@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+func TestLineEnd(t *testing.T) {
+	data := "a;1.0\nb;2.0\nc;3." + strings.Repeat("x", 5000)
+	f := strings.NewReader(data)
+	for _, tc := range []struct {
+		start, end, expected int64
+	}{
+		{0, int64(len(data)), 12},
+		{0, 12, 12},
+		{0, 11, 6},
+		{6, 11, 6},
+		{12, int64(len(data)), 12},
+		{0, 0, 0},
+	} {
+		if got := lineEnd(f, tc.start, tc.end); got != tc.expected {
+			t.Errorf("lineEnd(%d, %d) = %d, expected: %d", tc.start, tc.end, got, tc.expected)
+		}
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	filename := writeFile(t, "a;1.0\n")
+
+	// the stats are formatted in emit, followFile keeps changing them
+	outputs := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var last string // read after done
+	go func() {
+		defer close(done)
+		followFile(ctx, filename, 2, 4, 5*time.Millisecond, 5*time.Millisecond, func(stats aggregate.Results) {
+			var out bytes.Buffer
+			if err := aggregate.WriteOfficial(&out, stats); err != nil {
+				t.Error(err)
+			}
+			last = out.String()
+			select {
+			case outputs <- out.String():
+			default: // the test waits for a later output
+			}
+		})
+	}()
+
+	// the existing lines
+	waitForOutput(t, outputs, "{a=1.0/1.0/1.0}\n")
+
+	// appended lines, the last one is held back until its newline
+	appendFile(t, filename, "b;2.0\nc;3.")
+	waitForOutput(t, outputs, "{a=1.0/1.0/1.0, b=2.0/2.0/2.0}\n")
+	appendFile(t, filename, "0\n")
+	waitForOutput(t, outputs, "{a=1.0/1.0/1.0, b=2.0/2.0/2.0, c=3.0/3.0/3.0}\n")
+
+	// a truncated file is parsed again from the start
+	if err := os.WriteFile(filename, []byte("d;4.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutput(t, outputs, "{d=4.0/4.0/4.0}\n")
+
+	appendFile(t, filename, "d;-4.0\n")
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("followFile did not return")
+	}
+	// the final stats are emitted before returning
+	if last != "{d=-4.0/0.0/4.0}\n" {
+		t.Errorf("Wrong final output: %q", last)
+	}
+}
+
+func appendFile(t *testing.T, filename, data string) {
+	t.Helper()
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForOutput waits for expected to be emitted, skipping earlier outputs
+func waitForOutput(t *testing.T, outputs <-chan string, expected string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	var last string
+	for {
+		select {
+		case last = <-outputs:
+			if last == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected output %q, last: %q", expected, last)
+		}
+	}
+}
@@ -2,23 +2,43 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
 )
 
-// go run main.go [measurements_file]
+// go run main.go [-format official|json|ndjson|csv] [-rounding half-up|half-even|truncate] [-quantiles list] [-follow] [-strict] [-skip-invalid] [-stats] [-stats-json file] [measurements_file]
+// use "-" as measurements_file to read from stdin, gzip and zstd compressed
+// input is decompressed
+// with -follow the file is watched for appended lines after reaching the end,
+// results are written every -interval and on SIGUSR1 until interrupted
+// with -strict every line is validated by the aggregate package, as the fast
+// parser assumes valid input. invalid lines are logged with their offset and
+// line number and fail the run, with -skip-invalid only their count is logged
+// -rounding selects how means are rounded, the official results round half-up
+// -quantiles writes the listed quantiles, e.g. p50,p99,median,mode, after
+// min/mean/max. the histograms they need are counted by the aggregate package
+// -stats writes the number of stations of every chunk map to stderr, or of
+// every worker table in strict mode and for compressed or piped input, with
+// their slots and probe lengths. -stats-json writes them to a JSON file
 // tune env vars for performance
 //
 // Environment variables:
@@ -43,33 +63,24 @@ const (
 	mb                      = 1024 * 1024 // bytes
 )
 
-type Stats struct {
-	Min, Max, Sum float64
-	Count         int
-}
-
-// rounding floats to 1 decimal place with 0.05 rounding up to 0.1
-func round(x float64) float64 {
-	return math.Floor((x+0.05)*10) / 10
-}
-
-// parseFloatFast is a high performance float parser using the assumption that
-// the byte slice will always have a single decimal digit.
-func parseFloatFast(bs []byte) float64 {
+// parseTenthsFast is a high performance parser using the assumption that
+// the byte slice will always have a single decimal digit. It returns the
+// value in tenths, e.g. -12.3 as -123, so sums stay exact.
+func parseTenthsFast(bs []byte) int64 {
 	var intStartIdx int // is negative?
 	if bs[0] == '-' {
 		intStartIdx = 1
 	}
 
-	v := float64(bs[len(bs)-1]-'0') / 10 // single decimal digit
-	place := 1.0
+	v := int64(bs[len(bs)-1] - '0') // single decimal digit
+	place := int64(10)
 	for i := len(bs) - 3; i >= intStartIdx; i-- { // integer part
-		v += float64(bs[i]-'0') * place
+		v += int64(bs[i]-'0') * place
 		place *= 10
 	}
 
 	if intStartIdx == 1 {
-		v *= -1
+		v = -v
 	}
 	return v
 }
@@ -77,19 +88,19 @@ func parseFloatFast(bs []byte) float64 {
 // size is the intended number of bytes to parse. buffer should be longer than size
 // because we need to continue reading until the end of the line in order to
 // properly segment the entire file and not miss any data.
-func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
-	stats := make(map[string]*Stats, maxNameNum)
+func parseAt(f io.ReaderAt, buf []byte, offset int64, size int) aggregate.Results {
+	stats := make(aggregate.Results, maxNameNum)
 	n, err := f.ReadAt(buf, offset) // load the buffer
 	if err != nil && err != io.EOF {
 		log.Fatal(err)
 	}
 
-	lastName := make([]byte, maxNameLen) // last name parsed
-	var lastNameLen int
-	isScanningName := true // currently scanning name or value?
+	lastName := make([]byte, 0, maxNameLen) // last name parsed, grown for longer names
+	isScanningName := true                  // currently scanning name or value?
 
-	// if offset is non-zero, skip to the first new line
-	var idx, start int
+	// if offset is non-zero, skip to the first new line. start is the
+	// beginning of the name or value being scanned, lineStart of its line
+	var idx, start, lineStart int
 	if offset != 0 {
 		for idx < n {
 			if buf[idx] == '\n' {
@@ -99,14 +110,19 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 			}
 			idx++
 		}
+		// no newline at all, the chunk is part of a line of a previous chunk.
+		// or chunks smaller than a line, it belongs to the next chunk
+		if start == 0 || start > size {
+			return stats
+		}
+		lineStart = start
 	}
 	// tick tock between parsing names and values while accummulating stats
 	for {
 		if isScanningName {
 			for idx < n {
 				if buf[idx] == ';' {
-					nameBs := buf[start:idx]
-					lastNameLen = copy(lastName, nameBs)
+					lastName = append(lastName[:0], buf[start:idx]...)
 
 					idx++
 					start = idx
@@ -119,25 +135,11 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 			for idx < n {
 				if buf[idx] == '\n' {
 					valueBs := buf[start:idx]
-					value := parseFloatFast(valueBs)
-
-					nameUnsafe := unsafe.String(&lastName[0], lastNameLen)
-					if s, ok := stats[nameUnsafe]; !ok {
-						name := string(lastName[:lastNameLen]) // actually allocate string
-						stats[name] = &Stats{Min: value, Max: value, Sum: value, Count: 1}
-					} else {
-						if value < s.Min {
-							s.Min = value
-						}
-						if value > s.Max {
-							s.Max = value
-						}
-						s.Sum += value
-						s.Count++
-					}
+					addTenths(stats, lastName, parseTenthsFast(valueBs))
 
 					idx++
 					start = idx
+					lineStart = idx
 					isScanningName = true
 					break
 				}
@@ -145,37 +147,156 @@ func parseAt(f *os.File, buf []byte, offset int64, size int) map[string]*Stats {
 			}
 		}
 		// terminate when we hit the first newline after the intended size OR
-		// when we hit the end of the file
-		if (isScanningName && idx >= size) || idx >= n {
+		// when we hit the end of the file. a line starting right at the
+		// intended size is skipped by the next chunk, so it is parsed here
+		if (isScanningName && idx > size) || idx >= n {
 			break
 		}
 	}
 
+	switch {
+	case n == len(buf) && idx >= n && lineStart < n && lineStart <= size:
+		// a line of this chunk longer than the padding of buf is read on
+		// its own
+		parseLongLine(f, offset+int64(lineStart), stats)
+	case n < len(buf) && idx >= n && !isScanningName && start < n:
+		// the last line of the input without newline
+		addTenths(stats, lastName, parseTenthsFast(buf[start:n]))
+	}
+
 	return stats
 }
 
-func printResults(stats map[string]*Stats) { // doesn't help
-	// sorted alphabetically for output
-	names := make([]string, 0, len(stats))
-	for name := range stats {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-
-	var builder strings.Builder
-	for i, name := range names {
-		s := stats[name]
-		// gotcha: first round the sum to to remove float precision errors!
-		avg := round(round(s.Sum) / float64(s.Count))
-		builder.WriteString(fmt.Sprintf("%s=%.1f/%.1f/%.1f", name, s.Min, avg, s.Max))
-		if i < len(names)-1 {
-			builder.WriteString(", ")
+// addTenths adds value to the stats of name, name is only copied for new
+// stations
+func addTenths(stats aggregate.Results, name []byte, value int64) {
+	nameUnsafe := unsafe.String(unsafe.SliceData(name), len(name))
+	s, ok := stats[nameUnsafe]
+	if !ok {
+		s = &aggregate.Stats{}
+		stats[string(name)] = s // actually allocate string
+	}
+	s.Add(value)
+}
+
+// parseLongLine parses the line at offset into stats, which may be the last
+// line of the input without newline.
+func parseLongLine(f io.ReaderAt, offset int64, stats aggregate.Results) {
+	r := bufio.NewReader(io.NewSectionReader(f, offset, math.MaxInt64))
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+
+	name, value, ok := bytes.Cut(bytes.TrimSuffix(line, []byte{'\n'}), []byte{';'})
+	if !ok || len(value) == 0 {
+		return
+	}
+	stats.Add(string(name), parseTenthsFast(value))
+}
+
+// parseFile reads the file in chunks and parses them concurrently with
+// opts.Concurrency parsers.
+func parseFile(measurementsPath string, parseChunkSize int, opts aggregate.Options) aggregate.Results {
+	// read file
+	f, err := os.Open(measurementsPath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to open %s file: %w", measurementsPath, err))
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+	}
+
+	// compressed files are decompressed and parsed by the aggregate package,
+	// as are files in strict mode and with histograms
+	compression, err := aggregate.DetectCompression(f, info.Size())
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+	}
+	if compression != aggregate.Uncompressed || opts.Strict || opts.Histograms {
+		stats, err := aggregate.ProcessCompressed(context.Background(), f, info.Size(), compression, opts)
+		if err != nil {
+			log.Fatal(fmt.Errorf("failed to parse %v %s file: %w", compression, measurementsPath, err))
+		}
+		return stats
+	}
+
+	return parseSection(io.NewSectionReader(f, 0, info.Size()), opts.Concurrency, parseChunkSize, opts.OnTableStats)
+}
+
+// parseSection parses the lines of r in chunks concurrently. A trailing line
+// without newline is parsed as the last line. onTableStats, if not nil, is
+// called with the stats of the map of every chunk.
+func parseSection(r *io.SectionReader, numParsers, parseChunkSize int, onTableStats func(aggregate.TableStats)) aggregate.Results {
+	size := int(r.Size())
+	parseChunkSize = max(min(parseChunkSize, size), 1) // small sections, e.g. appended lines
+
+	// kick off "parser" workers
+	wg := sync.WaitGroup{}
+	wg.Add(numParsers)
+
+	// buffered to not block on merging
+	chunkOffsetCh := make(chan int64, numParsers)
+	chunkStatsCh := make(chan aggregate.Results, numParsers)
+
+	go func() {
+		i := 0
+		for i < size {
+			chunkOffsetCh <- int64(i)
+			i += parseChunkSize
+		}
+		close(chunkOffsetCh)
+	}()
+
+	for i := 0; i < numParsers; i++ {
+		// WARN: w/ extra padding for line overflow. Each chunk should be read past
+		// the intended size to the next new line. 128 bytes should be enough for
+		// a max 100 byte name + the float value.
+		buf := make([]byte, parseChunkSize+128)
+		go func() {
+			for chunkOffset := range chunkOffsetCh {
+				chunkStatsCh <- parseAt(r, buf, chunkOffset, parseChunkSize)
+			}
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(chunkStatsCh)
+	}()
+
+	mergedStats := make(aggregate.Results, maxNameNum)
+	chunks := 0
+	for chunkStats := range chunkStatsCh {
+		if onTableStats != nil {
+			// Go maps do not expose their slots
+			onTableStats(aggregate.TableStats{Table: fmt.Sprintf("chunk %d", chunks), Stations: len(chunkStats)})
 		}
+		chunks++
+		mergedStats.Merge(chunkStats)
 	}
+	return mergedStats
+}
 
-	writer := bufio.NewWriter(os.Stdout)
-	fmt.Fprintf(writer, "{%s}\n", builder.String())
-	writer.Flush()
+// parseStream parses a non-seekable input like a pipe, which may be gzip or
+// zstd compressed. A single reader hands newline aligned blocks to numParsers
+// parsers.
+func parseStream(r io.Reader, opts aggregate.Options) aggregate.Results {
+	zr, err := aggregate.NewReader(r)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to read input: %w", err))
+	}
+	defer zr.Close()
+
+	stats, err := aggregate.ProcessReader(context.Background(), zr, opts)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to parse input: %w", err))
+	}
+	return stats
 }
 
 // Read file in chunks and parse concurrently. N parsers work off of a chunk
@@ -209,9 +330,33 @@ func main() {
 		}
 	}
 
+	formats := strings.Join(aggregate.EncoderNames(), ", ")
+	format := flag.String("format", "official", "output format, one of: "+formats)
+	var rounding round.Mode
+	flag.Var(&rounding, "rounding", "rounding of means, one of: "+strings.Join(round.Names(), ", ")+", the official results round half-up")
+	follow := flag.Bool("follow", false, "keep parsing lines appended to the measurements file")
+	interval := flag.Duration("interval", 10*time.Second, "interval of writing results with -follow, 0 to only write on SIGUSR1")
+	pollInterval := flag.Duration("poll", time.Second, "interval of checking for appended lines with -follow without inotify")
+	strict := flag.Bool("strict", false, "log invalid lines with their offset and line number and fail")
+	skipInvalid := flag.Bool("skip-invalid", false, "skip invalid lines and log their count, implies -strict")
+	quantiles := flag.String("quantiles", "", "comma separated quantiles to output after min/mean/max: median, mode or pN, e.g. p50,p99.9")
+	tableStats := flag.Bool("stats", false, "write stats of the hash tables to stderr")
+	tableStatsJSON := flag.String("stats-json", "", "write stats of the hash tables as JSON to the given file")
+	flag.Parse()
+
+	encode := aggregate.Encoders[*format]
+	if encode == nil {
+		log.Fatal(fmt.Errorf("unknown format %q, must be one of: %s", *format, formats))
+	}
+	qs, err := aggregate.ParseQuantiles(*quantiles)
+	if err != nil {
+		log.Fatal(fmt.Errorf("invalid -quantiles: %w", err))
+	}
+	encodeOptions := aggregate.EncodeOptions{Quantiles: qs, Rounding: rounding}
+
 	measurementsPath := defaultMeasurementsPath
-	if len(os.Args) > 1 {
-		measurementsPath = os.Args[1]
+	if flag.NArg() > 0 {
+		measurementsPath = flag.Arg(0)
 	}
 
 	// profile code
@@ -232,70 +377,87 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	// read file
-	f, err := os.Open(measurementsPath)
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to open %s file: %w", measurementsPath, err))
+	opts := aggregate.Options{Concurrency: numParsers, Histograms: len(qs) > 0}
+	invalid := 0
+	if *strict || *skipInvalid {
+		opts.Strict = true
+		opts.OnInvalid = func(e *aggregate.LineError) {
+			if !*skipInvalid {
+				log.Printf("invalid %v", e)
+			}
+			invalid++
+		}
 	}
-	defer f.Close()
 
-	info, err := f.Stat()
-	if err != nil {
-		log.Fatal(fmt.Errorf("failed to read %s file: %w", measurementsPath, err))
+	var stats []aggregate.TableStats
+	if *tableStats || *tableStatsJSON != "" {
+		opts.OnTableStats = func(s aggregate.TableStats) {
+			stats = append(stats, s)
+		}
 	}
 
-	// kick off "parser" workers
-	wg := sync.WaitGroup{}
-	wg.Add(numParsers)
-
-	// buffered to not block on merging
-	chunkOffsetCh := make(chan int64, numParsers)
-	chunkStatsCh := make(chan map[string]*Stats, numParsers)
-
-	go func() {
-		i := 0
-		for i < int(info.Size()) {
-			chunkOffsetCh <- int64(i)
-			i += parseChunkSize
+	if *follow {
+		if measurementsPath == "-" {
+			log.Fatal(fmt.Errorf("-follow requires a measurements file"))
 		}
-		close(chunkOffsetCh)
-	}()
-
-	for i := 0; i < numParsers; i++ {
-		// WARN: w/ extra padding for line overflow. Each chunk should be read past
-		// the intended size to the next new line. 128 bytes should be enough for
-		// a max 100 byte name + the float value.
-		buf := make([]byte, parseChunkSize+128)
-		go func() {
-			for chunkOffset := range chunkOffsetCh {
-				chunkStatsCh <- parseAt(f, buf, chunkOffset, parseChunkSize)
+		if opts.Strict {
+			log.Fatal(fmt.Errorf("-strict and -skip-invalid can not be combined with -follow"))
+		}
+		if opts.OnTableStats != nil {
+			log.Fatal(fmt.Errorf("-stats and -stats-json can not be combined with -follow"))
+		}
+		if opts.Histograms {
+			log.Fatal(fmt.Errorf("-quantiles can not be combined with -follow"))
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		followFile(ctx, measurementsPath, numParsers, parseChunkSize, *interval, *pollInterval, func(stats aggregate.Results) {
+			if err := encode(os.Stdout, stats, encodeOptions); err != nil {
+				log.Fatal(fmt.Errorf("failed to write results: %w", err))
 			}
-			wg.Done()
-		}()
+		})
+		return
 	}
 
-	go func() {
-		wg.Wait()
-		close(chunkStatsCh)
-	}()
+	var mergedStats aggregate.Results
+	if measurementsPath == "-" {
+		mergedStats = parseStream(os.Stdin, opts)
+	} else {
+		mergedStats = parseFile(measurementsPath, parseChunkSize, opts)
+	}
 
-	mergedStats := make(map[string]*Stats, maxNameNum)
-	for chunkStats := range chunkStatsCh {
-		for name, s := range chunkStats {
-			if ms, ok := mergedStats[name]; !ok {
-				mergedStats[name] = s
-			} else {
-				if s.Min < ms.Min {
-					ms.Min = s.Min
-				}
-				if s.Max > ms.Max {
-					ms.Max = s.Max
-				}
-				ms.Sum += s.Sum
-				ms.Count += s.Count
-			}
+	if *tableStats {
+		if err := aggregate.WriteTableStats(os.Stderr, stats); err != nil {
+			log.Fatal(fmt.Errorf("failed to write stats: %w", err))
+		}
+	}
+	if *tableStatsJSON != "" {
+		if err := writeTableStatsJSON(*tableStatsJSON, stats); err != nil {
+			log.Fatal(fmt.Errorf("failed to write stats: %w", err))
 		}
 	}
 
-	printResults(mergedStats)
+	if invalid > 0 {
+		if !*skipInvalid {
+			log.Fatal(fmt.Errorf("found %d invalid lines", invalid))
+		}
+		log.Printf("skipped %d invalid lines", invalid)
+	}
+
+	if err := encode(os.Stdout, mergedStats, encodeOptions); err != nil {
+		log.Fatal(fmt.Errorf("failed to write results: %w", err))
+	}
+}
+
+// writeTableStatsJSON writes stats as JSON to the file filename.
+func writeTableStatsJSON(filename string, stats []aggregate.TableStats) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := aggregate.WriteTableStatsJSON(f, stats); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+func writeFile(t *testing.T, data string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func assertOfficial(t *testing.T, results aggregate.Results, expected string) {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := aggregate.WriteOfficial(&out, results); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestParseFloatDrift(t *testing.T) {
+	// measurements whose means are exactly halfway between tenths
+	var data strings.Builder
+	for i := 0; i < 1000; i++ {
+		data.WriteString("a;0.1\na;0.2\nb;-0.1\nb;-0.2\nc;12.3\nc;12.4\n")
+	}
+
+	// float64 sums drift below the halfway point of a and c, and round
+	// to the wrong tenth unlike the exact integer sums
+	float := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(data.String()))
+	for scanner.Scan() {
+		name, value, _ := strings.Cut(scanner.Text(), ";")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		float[name] += v
+	}
+	for name, drifted := range map[string]float64{"a": 0.1, "c": 12.3} {
+		if mean := math.Round(float[name]/2000*10) / 10; mean != drifted {
+			t.Errorf("Expected float64 mean of %s to drift to %v, got: %v", name, drifted, mean)
+		}
+	}
+
+	const expected = "{a=0.1/0.2/0.2, b=-0.2/-0.1/-0.1, c=12.3/12.4/12.4}\n"
+	exact := map[string]int64{"a": 3000, "b": -3000, "c": 247_000}
+	assertSums := func(t *testing.T, results aggregate.Results) {
+		t.Helper()
+		assertOfficial(t, results, expected)
+		for name, sum := range exact {
+			if s := results[name]; s.Sum != sum || s.Count != 2000 {
+				t.Errorf("Expected exact sum %d of 2000 measurements of %s, got: %+v", sum, name, s)
+			}
+		}
+	}
+
+	buf := make([]byte, data.Len()+128)
+	assertSums(t, parseAt(strings.NewReader(data.String()), buf, 0, data.Len()))
+
+	filename := writeFile(t, data.String())
+	for _, chunkSize := range []int{7, 1000, data.Len()} {
+		assertSums(t, parseFile(filename, chunkSize, aggregate.Options{Concurrency: runtime.NumCPU()}))
+	}
+}
+
+func TestParseLongNames(t *testing.T) {
+	// names longer than the padding of the chunk buffers and sharing
+	// prefixes, short and long last lines without newline
+	long := strings.Repeat("ä", 1000)
+	names := []string{"a", long[:50], long[:128], long[:128] + "b", long[:300], long}
+
+	for _, last := range []string{"", "a", long} {
+		expected := make(aggregate.Results)
+		var data strings.Builder
+		for i := range 3 {
+			for j, name := range names {
+				v := int64(i*10 + j)
+				expected.Add(name, v)
+				fmt.Fprintf(&data, "%s;%d.%d\n", name, v/10, v%10)
+			}
+		}
+		if last != "" {
+			expected.Add(last, -15)
+			data.WriteString(last + ";-1.5")
+		}
+		var out bytes.Buffer
+		if err := aggregate.WriteOfficial(&out, expected); err != nil {
+			t.Fatal(err)
+		}
+
+		filename := writeFile(t, data.String())
+		for _, chunkSize := range []int{1, 16, 100, 1000, 1 << 20} {
+			var got bytes.Buffer
+			if err := aggregate.WriteOfficial(&got, parseFile(filename, chunkSize, aggregate.Options{Concurrency: 3})); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != out.String() {
+				t.Errorf("Wrong output with last line of %.10q and chunks of %d bytes, expected:\n%s\ngot:\n%s", last, chunkSize, out.String(), got.String())
+			}
+		}
+	}
+}
+
+func TestParseFileQuantiles(t *testing.T) {
+	qs, err := aggregate.ParseQuantiles("p50,median,mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := writeFile(t, "Bosaso;5.0\nBosaso;20.0\nBosaso;-5.0\nBosaso;-15.0\nPetropavlovsk-Kamchatsky;9.5\nPetropavlovsk-Kamchatsky;-9.5\n")
+
+	var out bytes.Buffer
+	results := parseFile(filename, 16, aggregate.Options{Concurrency: 2, Histograms: true})
+	if err := aggregate.Encoders["official"](&out, results, aggregate.EncodeOptions{Quantiles: qs}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{Bosaso=-15.0/1.3/20.0/-5.0/0.0/-15.0, Petropavlovsk-Kamchatsky=-9.5/0.0/9.5/-9.5/0.0/-9.5}\n"; out.String() != expected {
+		t.Errorf("Wrong output, expected: %s, got: %s", expected, out.String())
+	}
+}
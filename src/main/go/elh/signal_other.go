@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// emitSignals make followFile emit the current stats, there is no SIGUSR1
+var emitSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// emitSignals make followFile emit the current stats
+var emitSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// watch notifies about changes of the file at path using inotify, and falls
+// back to polling every pollInterval if inotify is unavailable.
+func watch(ctx context.Context, path string, pollInterval time.Duration) <-chan struct{} {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		log.Printf("inotify unavailable, polling every %v: %v", pollInterval, err)
+		return pollChanges(ctx, pollInterval)
+	}
+	// non-blocking, so closing interrupts reads
+	inotify := os.NewFile(uintptr(fd), "inotify")
+
+	if _, err := syscall.InotifyAddWatch(fd, path, syscall.IN_MODIFY|syscall.IN_ATTRIB|syscall.IN_CLOSE_WRITE); err != nil {
+		inotify.Close()
+		log.Printf("failed to watch %s, polling every %v: %v", path, pollInterval, err)
+		return pollChanges(ctx, pollInterval)
+	}
+
+	go func() {
+		<-ctx.Done()
+		inotify.Close()
+	}()
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		// the events do not matter, the file is checked for any change
+		buf := make([]byte, 4096)
+		for {
+			if _, err := inotify.Read(buf); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("inotify failed, polling every %v: %v", pollInterval, err)
+					poll(ctx, pollInterval, changes)
+				}
+				return
+			}
+			notify(changes)
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// watch notifies about changes of the file at path by polling every
+// pollInterval.
+func watch(ctx context.Context, path string, pollInterval time.Duration) <-chan struct{} {
+	return pollChanges(ctx, pollInterval)
+}
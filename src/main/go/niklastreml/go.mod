@@ -2,4 +2,11 @@ module 1brc
 
 go 1.22.0
 
-require golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842
+require (
+	github.com/niklastreml/1brc-go/src/main/go/aggregate v0.0.0
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842
+)
+
+require github.com/klauspost/compress v1.18.0 // indirect
+
+replace github.com/niklastreml/1brc-go/src/main/go/aggregate => ../aggregate
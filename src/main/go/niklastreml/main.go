@@ -1,20 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"hash"
+	"io"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"slices"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/swar"
 	"golang.org/x/exp/mmap"
 )
 
 const (
-	filename        = "measurements.txt"
-	numKeys  uint64 = 413
+	defaultFilename = "measurements.txt"
+	// initial number of slots of a HashMap, tables grow as needed
+	initialKeys = 512
+	// initial number of bytes read at once by processChunk
+	blockSize = 64 * 1024
 )
 
 type TempCity struct {
@@ -22,94 +34,245 @@ type TempCity struct {
 	Temperature int
 }
 
+// config holds the command line options
+type config struct {
+	input      string
+	output     string
+	workers    int
+	chunkSize  int
+	format     string
+	cpuProfile string
+	quantiles  []aggregate.Quantile
+	rounding   round.Mode
+	hash       aggregate.Hash
+	serve      string
+
+	// stats writes the metrics of the hash tables to stderr, statsJSON to
+	// a file
+	stats     bool
+	statsJSON string
+
+	// strict validates every line, skipInvalid skips invalid lines rather
+	// than failing and implies strict
+	strict, skipInvalid bool
+}
+
 func main() {
-	reader, err := mmap.Open(filename)
+	cfg, err := parseFlags(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "1brc:", err)
+		os.Exit(2)
 	}
 
-	defer reader.Close()
+	if err := run(cfg, os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "1brc:", err)
+		os.Exit(1)
+	}
+}
 
-	workers := runtime.NumCPU() * 128
-	// workers := 3
+// parseFlags parses the command line arguments without the program name,
+// usage and flag errors are written to stderr
+func parseFlags(args []string, stderr io.Writer) (config, error) {
+	cfg := config{input: defaultFilename}
 
-	fmt.Println("Running with", workers, "workers")
+	fs := flag.NewFlagSet("1brc", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: 1brc [flags] [measurements.txt | -]")
+		fs.PrintDefaults()
+	}
+	fs.IntVar(&cfg.workers, "workers", runtime.NumCPU()*128, "number of concurrent workers")
+	fs.IntVar(&cfg.chunkSize, "chunk-size", 0, "size of a chunk in bytes, 0 splits the file evenly across workers")
+	fs.StringVar(&cfg.format, "format", "official", "output format, one of: "+strings.Join(formatNames(), ", "))
+	fs.StringVar(&cfg.output, "o", "", "write the results to this file instead of stdout")
+	fs.StringVar(&cfg.cpuProfile, "cpuprofile", "", "write a CPU profile to this file")
+	fs.StringVar(&cfg.serve, "serve", "", "after writing the results, serve them over HTTP on this address, e.g. :8080")
+	fs.BoolVar(&cfg.strict, "strict", false, "report invalid lines with their offset and line number and fail, the fast parser assumes valid input")
+	fs.BoolVar(&cfg.skipInvalid, "skip-invalid", false, "skip invalid lines and report their count, implies -strict")
+	fs.Var(&cfg.rounding, "rounding", "rounding of means, one of: "+strings.Join(round.Names(), ", ")+", the official results round half-up")
+	fs.Var(&cfg.hash, "hash", "hash of station names, one of: "+strings.Join(aggregate.HashNames(), ", ")+", fnv1a is unseeded and slow on names crafted to collide")
+	fs.BoolVar(&cfg.stats, "stats", false, "write hash table metrics of every chunk to stderr")
+	fs.StringVar(&cfg.statsJSON, "stats-json", "", "write hash table metrics of every chunk as JSON to this file")
+	quantiles := fs.String("quantiles", "", "comma separated quantiles to output after min/mean/max: median, mode or pN, e.g. p50,p99.9")
+
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		cfg.input = fs.Arg(0)
+	default:
+		return config{}, fmt.Errorf("expected at most one input file, got %d", fs.NArg())
+	}
 
-	chunkSize := reader.Len() / workers
+	if cfg.workers < 1 {
+		return config{}, fmt.Errorf("invalid -workers %d, must be at least 1", cfg.workers)
+	}
+	if cfg.chunkSize < 0 {
+		return config{}, fmt.Errorf("invalid -chunk-size %d, must not be negative", cfg.chunkSize)
+	}
+	if _, ok := formats[cfg.format]; !ok {
+		return config{}, fmt.Errorf("unknown -format %q, must be one of: %s", cfg.format, strings.Join(formatNames(), ", "))
+	}
 
-	fmt.Printf("Using %d chunks of %d bytes\n", workers, chunkSize)
+	if cfg.skipInvalid {
+		cfg.strict = true
+	}
 
-	// prealloc := chunkSize / 1500
+	var err error
+	if cfg.quantiles, err = aggregate.ParseQuantiles(*quantiles); err != nil {
+		return config{}, fmt.Errorf("invalid -quantiles: %w", err)
+	}
+	return cfg, nil
+}
 
-	// fmt.Printf("Pre allocating %d map keys\n", prealloc)
+// encodeOptions returns the options for writing the results
+func (cfg config) encodeOptions() aggregate.EncodeOptions {
+	return aggregate.EncodeOptions{Quantiles: cfg.quantiles, Rounding: cfg.rounding}
+}
 
-	f, err := os.Create("profile.prof")
-	if err != nil {
-		panic(err)
+func formatNames() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
 	}
-	defer f.Close()
-	if err := pprof.StartCPUProfile(f); err != nil {
-		panic(err)
+	sort.Strings(names)
+	return names
+}
+
+// run processes the input of cfg, an input of "-" is read from stdin
+func run(cfg config, stdin io.Reader, stdout, stderr io.Writer) error {
+	if cfg.cpuProfile != "" {
+		f, err := os.Create(cfg.cpuProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
 	}
-	defer pprof.StopCPUProfile()
 
-	var wg sync.WaitGroup
-	wg.Add(workers)
+	if cfg.input == "-" {
+		return runStream(cfg, stdin, stdout, stderr)
+	}
+	return runFile(cfg, stdout, stderr)
+}
 
-	results := make(chan HashMap, workers)
+// runStream processes measurements piped to stdin, which cannot be mapped
+// into memory and is read sequentially in chunks instead
+func runStream(cfg config, stdin io.Reader, stdout, stderr io.Writer) error {
+	fmt.Fprintln(stderr, "Running with", cfg.workers, "workers on stdin")
 
-	for w := range workers {
-		go func(w, start, end int) {
-			// fmt.Println("starting worker", w, start, end)
-			// move forward to first newline
-			if start != 0 {
-				for i := start; ; i++ {
-					if reader.At(i) == '\n' {
-						start = i + 1
-						break
-					}
-				}
-			}
+	return runAggregate(cfg, stdout, stderr, func(opts aggregate.Options) (aggregate.Results, error) {
+		return aggregate.ProcessReader(context.Background(), stdin, opts)
+	})
+}
 
-			// result := make(map[string]*Result, prealloc) // map[string]*Result{}
-			//result := make([]*Result, numKeys)
-			result := HashMap{
-				Data:   make([]*Result, numKeys),
-				Reader: reader,
+// runAggregate processes the input with the aggregate package rather than the
+// HashMap of runFile, which needs names from a mapped file
+func runAggregate(cfg config, stdout, stderr io.Writer, process func(opts aggregate.Options) (aggregate.Results, error)) error {
+	invalid := 0
+	opts := aggregate.Options{
+		Concurrency: cfg.workers,
+		ChunkSize:   cfg.chunkSize,
+		Histograms:  len(cfg.quantiles) > 0,
+		Strict:      cfg.strict,
+		Hash:        cfg.hash,
+	}
+	if cfg.strict {
+		opts.OnInvalid = func(e *aggregate.LineError) {
+			if !cfg.skipInvalid {
+				fmt.Fprintln(stderr, "Invalid", e)
 			}
+			invalid++
+		}
+	}
+	var stats []aggregate.TableStats
+	if cfg.stats || cfg.statsJSON != "" {
+		opts.OnTableStats = func(s aggregate.TableStats) {
+			stats = append(stats, s)
+		}
+	}
 
-			for i := start; i < end; {
-				var b int
-				nameLength, number, b := ReadLine(reader, i)
-				temperature := ParseFloatIntoInt(number)
-
-				if v := result.Load(i, nameLength); v == nil {
-					r := Result{
-						i, nameLength, temperature, temperature, temperature, 1,
-					}
-
-					result.Store(&r)
-				} else {
-					v.Amount++
-					v.Sum += temperature
-					if v.Min > temperature {
-						v.Min = temperature
-					} else if v.Max < temperature {
-						v.Max = temperature
-					}
-				}
+	results, err := process(opts)
+	if err != nil {
+		return err
+	}
+	if err := writeTableStats(cfg, stderr, stats); err != nil {
+		return err
+	}
+	if invalid > 0 {
+		if !cfg.skipInvalid {
+			return fmt.Errorf("found %d invalid lines", invalid)
+		}
+		fmt.Fprintln(stderr, "Skipped", invalid, "invalid lines")
+	}
 
-				i += b + 1
+	err = writeOutput(cfg, stdout, func(w io.Writer) error {
+		return streamFormats[cfg.format](w, results, cfg.encodeOptions())
+	})
+	if err != nil || cfg.serve == "" {
+		return err
+	}
+	return serve(cfg, results, stderr)
+}
 
-				// reduce for testing
-				// if i > chunkSize/100 {
-				// 	break
-				// }
-			}
+// runFile processes a measurements file mapped into memory
+func runFile(cfg config, stdout, stderr io.Writer) error {
+	reader, err := mmap.Open(cfg.input)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	if cfg.strict {
+		fmt.Fprintln(stderr, "Running with", cfg.workers, "workers validating every line")
+		return runAggregate(cfg, stdout, stderr, func(opts aggregate.Options) (aggregate.Results, error) {
+			return aggregate.Process(context.Background(), reader, int64(reader.Len()), opts)
+		})
+	}
+
+	nChunks := cfg.workers
+	if cfg.chunkSize > 0 {
+		nChunks = max((reader.Len()+cfg.chunkSize-1)/cfg.chunkSize, 1)
+	}
+	chunks := planChunks(reader, nChunks)
+	workers := min(cfg.workers, len(chunks))
+
+	fmt.Fprintln(stderr, "Running with", workers, "workers")
+	fmt.Fprintf(stderr, "Using %d chunks of %d bytes\n", len(chunks), chunkSize(reader.Len(), nChunks))
+
+	// prealloc := chunkSize / 1500
 
-			results <- result
+	// fmt.Printf("Pre allocating %d map keys\n", prealloc)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	pending := make(chan chunk, len(chunks))
+	for _, c := range chunks {
+		pending <- c
+	}
+	close(pending)
+
+	results := make(chan HashMap, len(chunks))
+
+	for w := range workers {
+		go func(w int) {
+			for c := range pending {
+				// fmt.Println("worker", w, "processing", c.start, c.end)
+				results <- processChunk(reader, c.start, c.end, len(cfg.quantiles) > 0, cfg.hash)
+			}
 			wg.Done()
-		}(w, w*chunkSize, w*chunkSize+chunkSize)
+		}(w)
 	}
 
 	go func() {
@@ -117,107 +280,214 @@ func main() {
 		close(results)
 	}()
 
-	// results.Range(func(k string, v Result) bool {
-	// 	fmt.Printf("%s;%.2f;%.2f;%.2f\n", k, float32(v.Min)/10, float32(v.Sum/v.Amount)/10, float32(v.Max)/10)
-	// 	return true
-	// })
-	final := make([]*Result, numKeys)
+	final := NewHashMap(reader, initialKeys, cfg.hash)
 
+	var stats []aggregate.TableStats
 	nDone := 0
 	for m := range results {
 		nDone++
-		// fmt.Printf("Got results %d/%d\r", nDone, workers)
-		for k, originalV := range m.Data {
-			if finalV := final[k]; finalV != nil {
-				if finalV.Max < originalV.Max {
-					finalV.Max = originalV.Max
-				}
-				if finalV.Min > originalV.Min {
-					finalV.Min = originalV.Min
-				}
+		// fmt.Printf("Got results %d/%d\r", nDone, len(chunks))
+		if cfg.stats || cfg.statsJSON != "" {
+			// numbered in the order the chunks are done
+			stats = append(stats, m.Stats(fmt.Sprintf("chunk %d", nDone)))
+		}
+		final.Merge(&m)
+	}
+	if cfg.stats || cfg.statsJSON != "" {
+		stats = append(stats, final.Stats("merged"))
+	}
+	if err := writeTableStats(cfg, stderr, stats); err != nil {
+		return err
+	}
 
-				finalV.Sum += originalV.Sum
-				finalV.Amount += originalV.Amount
-				final[k] = finalV
-			} else {
-				final[k] = originalV
-			}
+	err = writeOutput(cfg, stdout, func(w io.Writer) error {
+		return formats[cfg.format](w, reader, final.Data, cfg.encodeOptions())
+	})
+	if err != nil || cfg.serve == "" {
+		return err
+	}
+	return serve(cfg, toResults(reader, final.Data), stderr)
+}
+
+// writeTableStats writes stats to stderr if cfg.stats is set and as JSON to
+// cfg.statsJSON if set
+func writeTableStats(cfg config, stderr io.Writer, stats []aggregate.TableStats) error {
+	if cfg.stats {
+		if err := aggregate.WriteTableStats(stderr, stats); err != nil {
+			return err
 		}
 	}
+	if cfg.statsJSON == "" {
+		return nil
+	}
+	return writeOutput(config{output: cfg.statsJSON}, nil, func(w io.Writer) error {
+		return aggregate.WriteTableStatsJSON(w, stats)
+	})
+}
+
+// writeOutput calls write with the output file of cfg or stdout if none is set
+func writeOutput(cfg config, stdout io.Writer, write func(w io.Writer) error) (err error) {
+	if cfg.output == "" {
+		return write(stdout)
+	}
 
-	slices.SortFunc(final, func(a, b *Result) int {
-		// ensure nil go to the end of the array
-		if a == nil {
-			return 1
+	f, err := os.Create(cfg.output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
 		}
-		if b == nil {
-			return -1
+	}()
+	return write(f)
+}
+
+// chunk is a range of whole lines [start, end) of the file
+type chunk struct {
+	start, end int
+}
+
+// chunkSize returns the size of chunks before they get aligned on lines
+func chunkSize(size, workers int) int {
+	return max((size+workers-1)/workers, 1)
+}
+
+// planChunks splits the file into at most workers chunks of roughly equal size.
+// Every chunk ends after a newline (or at the end of the file), so the chunks
+// cover every line exactly once.
+func planChunks(reader *mmap.ReaderAt, workers int) []chunk {
+	size := reader.Len()
+	step := chunkSize(size, workers)
+
+	chunks := make([]chunk, 0, min(workers, size))
+	for start := 0; start < size; {
+		end := start + step
+		if end >= size || len(chunks) == workers-1 {
+			end = size
+		} else {
+			// move forward past the next newline
+			for end < size && reader.At(end-1) != '\n' {
+				end++
+			}
 		}
-		swapped := 1
-		if a.NameLength > b.NameLength {
-			a, b = b, a
-			swapped = -1
+		chunks = append(chunks, chunk{start, end})
+		start = end
+	}
+	return chunks
+}
+
+// processChunk aggregates all lines in [start, end), start must be the
+// beginning of a line. histograms enables Result.Histogram for quantiles.
+//
+// The lines are read in blocks of complete lines, a block grows to hold a
+// line longer than it.
+func processChunk(reader *mmap.ReaderAt, start, end int, histograms bool, hash aggregate.Hash) HashMap {
+	result := NewHashMap(reader, initialKeys, hash)
+
+	block := make([]byte, blockSize)
+	for off := start; off < end; {
+		read, _ := reader.ReadAt(block[:min(len(block), end-off)], int64(off))
+		data := block[:read]
+		if off+read < end {
+			data = data[:bytes.LastIndexByte(data, '\n')+1]
+			if len(data) == 0 {
+				block = make([]byte, 2*len(block))
+				continue
+			}
 		}
 
-		for i := range a.NameLength {
-			aName := a.NameAddr + i
-			bName := b.NameAddr + i
+		for i := 0; i < len(data); {
+			nameLength, temperature, n, ok := ReadLine(data[i:])
+			if !ok {
+				// malformed lines are only reported with -strict
+				i += n
+				continue
+			}
+			name := data[i : i+nameLength]
+
+			if v := result.lookup(result.hasher.Sum(name), off+i, name); v == nil {
+				r := Result{
+					NameAddr:   off + i,
+					NameLength: nameLength,
+				}
+				if histograms {
+					r.Histogram = new(aggregate.Histogram)
+					r.Histogram.Add(temperature)
+				}
+				r.Add(temperature)
 
-			aByte, bByte := reader.At(aName), reader.At(bName)
-			if aByte < bByte {
-				return -1 * swapped
-			} else if aByte > bByte {
-				return 1 * swapped
+				result.Store(&r)
+			} else {
+				v.Add(temperature)
+				if v.Histogram != nil {
+					v.Histogram.Add(temperature)
+				}
 			}
-		}
 
-		if b.NameLength > a.NameLength {
-			// special case where a is a substring of b
-			// a = "Hamburg"
-			// b = "Hamburger"
-			// since a is always less than b, we declare that the longer string 'b' should be sorted
-			// after the shorter string 'a'
-			return -1
+			i += n
 		}
-		return 0
-	})
+		off += len(data)
+	}
 
-	// allocate a buffer of 50 bytes for the read at which we can reuse
-	b := make([]byte, 50)
-	for _, v := range final {
-		// if v is nil, no more data will come after it
-		if v == nil {
+	return result
+}
+
+// ReadLine reads the line at the start of data a word of 8 bytes at a time,
+// see package swar. It returns the length of the name, the temperature in
+// tenths, the length of the line including the newline and false if the line
+// has no name or a value that is too long or out of range. Lines which do
+// not fit the words, such as the last line of the file without a newline,
+// are read byte by byte.
+func ReadLine(data []byte) (int, int64, int, bool) {
+	for i := 0; i < len(data); i += 8 {
+		w := swar.Load(data[i:])
+		semi := swar.Index(w, ';')
+		if swar.Index(w, '\n') < semi {
+			break // no semicolon in the line
+		}
+		if semi < 8 {
+			if temperature, n := swar.ParseNumber(swar.Load(data[i+semi+1:])); n > 0 {
+				return i + semi, temperature, i + semi + 1 + n, inRange(temperature)
+			}
 			break
 		}
-		reader.ReadAt(b, int64(v.NameAddr))
-		fmt.Printf("%s;%.1f;%.1f;%.1f\n", b[:v.NameLength], float32(v.Min)/10, float32(v.Sum/v.Amount)/10, float32(v.Max)/10)
 	}
+	return readLineBytewise(data)
+}
 
+// inRange reports whether tenths is a valid temperature
+func inRange(tenths int64) bool {
+	return tenths >= aggregate.MinTenths && tenths <= aggregate.MaxTenths
 }
 
-// ReadLine reads one line from reader and reads it into a name and number string
-// start should be the adress of the beginning of the line
-// the first is the length of the name
-// the second is the read number without decimals and in reverse
-// the last is the number of bytes read in total, for advancing the read pointer
-func ReadLine(reader *mmap.ReaderAt, start int) (int, [5]byte, int) {
+// readLineBytewise is ReadLine one byte at a time
+func readLineBytewise(data []byte) (int, int64, int, bool) {
 	// we need to write this in reverse
 	numberBuilder := [5]byte{}
 	nameLength := 0
 	nameDone := false
+	tooLong := false
 
 	readBytes := 0
 	nI := 4
-	for ; ; readBytes++ {
-		b := reader.At(start + readBytes)
+	for ; readBytes < len(data); readBytes++ {
+		b := data[readBytes]
 		if b == '\n' {
+			readBytes++
 			break
 		}
 		if b != ';' {
-			if b == '.' {
-				continue
-			}
 			if nameDone {
+				// names may contain dots, only skip the decimal point
+				if b == '.' {
+					continue
+				}
+				if nI < 0 {
+					// more characters than numberBuilder holds
+					tooLong = true
+					continue
+				}
 				numberBuilder[nI] = b
 				nI--
 				continue
@@ -229,7 +499,11 @@ func ReadLine(reader *mmap.ReaderAt, start int) (int, [5]byte, int) {
 		}
 	}
 
-	return nameLength, numberBuilder, readBytes
+	if !nameDone || tooLong {
+		return nameLength, 0, readBytes, false
+	}
+	temperature := int64(ParseFloatIntoInt(numberBuilder))
+	return nameLength, temperature, readBytes, inRange(temperature)
 }
 
 func ParseFloatIntoInt(f [5]byte) int {
@@ -273,38 +547,145 @@ func ipow(base, exp int) int {
 	return result
 }
 
+// Result holds the stats of the station whose name is at NameAddr in the file
 type Result struct {
 	NameAddr   int
 	NameLength int
-	Min        int
-	Max        int
-	Sum        int
-	Amount     int
+	aggregate.Stats
 }
 
+// HashMap is an open addressing hash table with linear probing keyed by
+// station names inside the mmapped file. Names are compared byte by byte, so
+// colliding names get their own slots. The table doubles once it is 3/4 full.
 type HashMap struct {
 	Data   []*Result
 	Reader *mmap.ReaderAt
-	h      hash.Hash64
+	count  int
+	hasher aggregate.Hasher
+	name   []byte // the name being probed
+	other  []byte // the name it is compared to
+}
+
+// NewHashMap creates a HashMap with at least size slots hashing names with a
+// random seed of hash
+func NewHashMap(reader *mmap.ReaderAt, size int, hash aggregate.Hash) HashMap {
+	slots := 1
+	for slots < size {
+		slots <<= 1
+	}
+	return HashMap{
+		Data:   make([]*Result, slots),
+		Reader: reader,
+		hasher: aggregate.NewHasher(hash),
+		name:   make([]byte, 0, 128),
+		other:  make([]byte, 0, 128),
+	}
 }
 
+// Len returns the number of stored results
+func (h *HashMap) Len() int {
+	return h.count
+}
+
+// Store adds d to the map, d must not be present yet
 func (h *HashMap) Store(d *Result) {
-	h.Data[h.hashfnv(d.NameAddr, d.NameLength)] = d
+	if (h.count+1)*4 > len(h.Data)*3 {
+		h.grow()
+	}
+	h.Data[h.probe(d.NameAddr, d.NameLength)] = d
+	h.count++
 }
 
+// Load returns the result for the name at addr or nil if there is none
 func (h *HashMap) Load(addr, length int) *Result {
-	return h.Data[h.hashfnv(addr, length)]
+	return h.Data[h.probe(addr, length)]
 }
 
-const prime64 = 1099511628211
+// lookup is Load of the name at addr which has been read into name and
+// hashed
+func (h *HashMap) lookup(hash uint64, addr int, name []byte) *Result {
+	return h.Data[h.probeName(hash, addr, name)]
+}
 
-func (h *HashMap) hashfnv(addr, length int) uint64 {
-	var hash uint64 = 0
+// Merge adds all results of o into h
+func (h *HashMap) Merge(o *HashMap) {
+	for _, originalV := range o.Data {
+		if originalV == nil {
+			continue
+		}
+		if finalV := h.Load(originalV.NameAddr, originalV.NameLength); finalV != nil {
+			finalV.Merge(&originalV.Stats)
+		} else {
+			h.Store(originalV)
+		}
+	}
+}
 
-	for i := range length {
-		hash ^= uint64(h.Reader.At(addr + i))
-		hash *= prime64
+// probe returns the slot holding the name at addr, or the free slot
+// terminating its probe chain
+func (h *HashMap) probe(addr, length int) uint64 {
+	hash := h.hash(addr, length)
+	return h.probeName(hash, addr, h.name)
+}
+
+// probeName is probe of the name at addr which has been read into name and
+// hashed
+func (h *HashMap) probeName(hash uint64, addr int, name []byte) uint64 {
+	mask := uint64(len(h.Data) - 1)
+	i := hash & mask
+	for {
+		r := h.Data[i]
+		if r == nil || h.equal(r, addr, name) {
+			return i
+		}
+		i = (i + 1) & mask
+	}
+}
+
+func (h *HashMap) equal(r *Result, addr int, name []byte) bool {
+	if r.NameLength != len(name) {
+		return false
+	}
+	if r.NameAddr == addr {
+		return true
 	}
+	h.other = h.read(h.other, r.NameAddr, r.NameLength)
+	return bytes.Equal(h.other, name)
+}
+
+func (h *HashMap) grow() {
+	old := h.Data
+	h.Data = make([]*Result, len(old)*2)
+	for _, r := range old {
+		if r != nil {
+			h.Data[h.probe(r.NameAddr, r.NameLength)] = r
+		}
+	}
+}
+
+// Stats returns the metrics of the table, the names are hashed again to find
+// their probe lengths
+func (h *HashMap) Stats(name string) aggregate.TableStats {
+	s := aggregate.TableStats{Table: name, Stations: h.count, Entries: len(h.Data)}
+	mask := uint64(len(h.Data) - 1)
+	for i, r := range h.Data {
+		if r != nil {
+			home := h.hash(r.NameAddr, r.NameLength) & mask
+			s.AddSlot(int((uint64(i)-home)&mask) + 1)
+		}
+	}
+	return s
+}
+
+// hash reads the name at addr into h.name and returns its hash
+func (h *HashMap) hash(addr, length int) uint64 {
+	h.name = h.read(h.name, addr, length)
+	return h.hasher.Sum(h.name)
+}
 
-	return hash % numKeys
+// read reads the name at addr into buf
+func (h *HashMap) read(buf []byte, addr, length int) []byte {
+	buf = slices.Grow(buf[:0], length)[:length]
+	h.Reader.ReadAt(buf, int64(addr))
+	return buf
 }
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate/round"
+	"golang.org/x/exp/mmap"
+)
+
+const samplesDir = "../../../test/resources/samples"
+
+func openData(t *testing.T, data string) *mmap.ReaderAt {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return openFile(t, name)
+}
+
+func openFile(t *testing.T, name string) *mmap.ReaderAt {
+	t.Helper()
+
+	reader, err := mmap.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	return reader
+}
+
+func name(reader *mmap.ReaderAt, r *Result) string {
+	b := make([]byte, r.NameLength)
+	reader.ReadAt(b, int64(r.NameAddr))
+	return string(b)
+}
+
+func TestReadLine(t *testing.T) {
+	// names at every alignment to the words, a number the words do not
+	// parse and a last line without newline read byte by byte
+	type line struct {
+		name        string
+		temperature int64
+		text        string
+	}
+	var lines []line
+	for n := 0; n <= 20; n++ {
+		name := strings.Repeat("a.", n)[:n]
+		lines = append(lines, line{name, int64(n*7 - 70), fmt.Sprintf("%s;%.1f\n", name, float64(n*7-70)/10)})
+	}
+	lines = append(lines, line{"b", 123, "b;12.3\n"}, line{"c", 5, "c;.5\n"}, line{"d", -15, "d;-1.5"})
+
+	var data []byte
+	for _, l := range lines {
+		data = append(data, l.text...)
+	}
+
+	start := 0
+	for _, l := range lines {
+		nameLength, temperature, n, ok := ReadLine(data[start:])
+		if name := data[start : start+nameLength]; string(name) != l.name || temperature != l.temperature || n != len(l.text) || !ok {
+			t.Errorf("ReadLine(%q) = %q, %d, %d, %v, expected: %q, %d, %d", l.text, name, temperature, n, ok, l.name, l.temperature, len(l.text))
+		}
+		start += n
+	}
+
+	// malformed lines are skipped whole
+	for _, text := range []string{"a;123456.7\n", "a;1234567\n", "a;100.0\n", "a;9:.9\n", "no semicolon\n"} {
+		if _, _, n, ok := ReadLine([]byte(text + "b;1.0\n")); ok || n != len(text) {
+			t.Errorf("ReadLine(%q) = %d bytes, %v, expected %d bytes of a malformed line", text, n, ok, len(text))
+		}
+	}
+}
+
+func TestProcessChunkMalformed(t *testing.T) {
+	reader := openData(t, "a;1.0\nb;123456.7\nc;1234567890\na;3.0\n")
+	for _, histograms := range []bool{false, true} {
+		result := processChunk(reader, 0, reader.Len(), histograms, aggregate.HashWyhash)
+		var out bytes.Buffer
+		if err := aggregate.WriteOfficial(&out, toResults(reader, result.Data)); err != nil {
+			t.Fatal(err)
+		}
+		if expected := "{a=1.0/2.0/3.0}\n"; out.String() != expected {
+			t.Errorf("Wrong output, expected: %q, got: %q", expected, out.String())
+		}
+	}
+}
+
+func TestHashMapCollisions(t *testing.T) {
+	const slots = 64
+
+	// find names which land in the same slot of a table with 64 slots, with
+	// the unseeded hash of both tables
+	var data strings.Builder
+	for i := range 1000 {
+		data.WriteString("s" + strconv.Itoa(i) + "\n")
+	}
+	reader := openData(t, data.String())
+	probe := NewHashMap(reader, slots, aggregate.HashFNV1a)
+
+	var colliding []*Result
+	bucket := uint64(0)
+	for addr := 0; addr < reader.Len() && len(colliding) < 4; {
+		length := 0
+		for reader.At(addr+length) != '\n' {
+			length++
+		}
+		if b := probe.hash(addr, length) & (slots - 1); len(colliding) == 0 || b == bucket {
+			bucket = b
+			colliding = append(colliding, &Result{NameAddr: addr, NameLength: length})
+		}
+		addr += length + 1
+	}
+	if len(colliding) < 4 {
+		t.Fatalf("Expected 4 colliding names, got %d", len(colliding))
+	}
+
+	h := NewHashMap(reader, slots, aggregate.HashFNV1a)
+	for _, r := range colliding {
+		if v := h.Load(r.NameAddr, r.NameLength); v != nil {
+			t.Fatalf("Unexpected result for %s: %s", name(reader, r), name(reader, v))
+		}
+		h.Store(r)
+	}
+	if len(h.Data) != slots {
+		t.Fatalf("Expected table of %d slots, got %d", slots, len(h.Data))
+	}
+	for _, r := range colliding {
+		if v := h.Load(r.NameAddr, r.NameLength); v != r {
+			t.Errorf("Wrong result for %s: %+v", name(reader, r), v)
+		}
+	}
+	if h.Len() != len(colliding) {
+		t.Errorf("Expected %d results, got %d", len(colliding), h.Len())
+	}
+}
+
+func TestHashMapGrow(t *testing.T) {
+	reader := openData(t, "a\nb\nc\nd\ne\nf\ng\nh\n")
+
+	h := NewHashMap(reader, 1, aggregate.HashWyhash)
+	for addr := 0; addr < reader.Len(); addr += 2 {
+		h.Store(&Result{NameAddr: addr, NameLength: 1})
+	}
+	if h.Len() != 8 {
+		t.Fatalf("Expected 8 results, got %d", h.Len())
+	}
+	if len(h.Data) < 8 || len(h.Data)&(len(h.Data)-1) != 0 {
+		t.Errorf("Unexpected table size: %d", len(h.Data))
+	}
+	for addr := 0; addr < reader.Len(); addr += 2 {
+		if v := h.Load(addr, 1); v == nil || v.NameAddr != addr {
+			t.Errorf("Wrong result for %c: %+v", reader.At(addr), v)
+		}
+	}
+}
+
+func TestProcessChunkUniqueKeys(t *testing.T) {
+	filename := filepath.Join(samplesDir, "measurements-10000-unique-keys.txt")
+
+	expected := referenceResults(t, filename)
+	if len(expected) != 10_000 {
+		t.Fatalf("Expected 10000 stations in sample, got %d", len(expected))
+	}
+
+	reader := openFile(t, filename)
+	result := processChunk(reader, 0, reader.Len(), false, aggregate.HashWyhash)
+
+	// merging into an empty map must not change anything
+	final := NewHashMap(reader, initialKeys, aggregate.HashWyhash)
+	final.Merge(&result)
+
+	if final.Len() != len(expected) {
+		t.Fatalf("Expected %d stations, got %d", len(expected), final.Len())
+	}
+	for _, v := range final.Data {
+		if v == nil {
+			continue
+		}
+		n := name(reader, v)
+		e, ok := expected[n]
+		if !ok {
+			t.Errorf("Unexpected station %q", n)
+			continue
+		}
+		if v.Stats != e {
+			t.Errorf("Wrong result for %q, expected: %+v, got: %+v", n, e, v)
+		}
+	}
+}
+
+// referenceResults aggregates filename with the standard library
+func referenceResults(t *testing.T, filename string) map[string]aggregate.Stats {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	results := make(map[string]aggregate.Stats)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, _ := strings.Cut(scanner.Text(), ";")
+		temperature, err := strconv.ParseInt(strings.Replace(value, ".", "", 1), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, ok := results[name]
+		if !ok {
+			r = aggregate.Stats{Min: temperature, Max: temperature}
+		}
+		r.Min = min(r.Min, temperature)
+		r.Max = max(r.Max, temperature)
+		r.Sum += temperature
+		r.SumSquares += temperature * temperature
+		r.Count++
+		results[name] = r
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestPlanChunks(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := range 200 {
+		lines := rnd.Intn(100)
+		if i%10 == 0 {
+			lines = rnd.Intn(3)
+		}
+
+		var data strings.Builder
+		for range lines {
+			fmt.Fprintf(&data, "s%d;%.1f\n", rnd.Intn(20), float64(rnd.Intn(1999)-999)/10)
+		}
+		reader := openData(t, data.String())
+
+		workers := 1 + rnd.Intn(300)
+		chunks := planChunks(reader, workers)
+		if len(chunks) > workers {
+			t.Fatalf("Expected at most %d chunks, got %d", workers, len(chunks))
+		}
+
+		amount, next := 0, 0
+		for _, c := range chunks {
+			if c.start != next || c.end <= c.start {
+				t.Fatalf("Chunks do not cover the file: %v", chunks)
+			}
+			if reader.At(c.end-1) != '\n' {
+				t.Fatalf("Chunk %v does not end on a newline", c)
+			}
+			next = c.end
+
+			result := processChunk(reader, c.start, c.end, false, aggregate.HashWyhash)
+			for _, v := range result.Data {
+				if v != nil {
+					amount += int(v.Count)
+				}
+			}
+		}
+		if next != reader.Len() {
+			t.Fatalf("Chunks do not cover the file: %v, size: %d", chunks, reader.Len())
+		}
+		if amount != lines {
+			t.Errorf("Expected %d lines with %d workers, got %d", lines, workers, amount)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected config
+		err      string
+	}{
+		{args: nil, expected: config{input: "measurements.txt", workers: -1, format: "official"}},
+		{
+			args:     []string{"-workers", "3", "-chunk-size", "1024", "-format", "lines", "-o", "out.txt", "-cpuprofile", "cpu.prof", "in.txt"},
+			expected: config{input: "in.txt", output: "out.txt", workers: 3, chunkSize: 1024, format: "lines", cpuProfile: "cpu.prof"},
+		},
+		{
+			args:     []string{"-quantiles", "median,p99", "-"},
+			expected: config{input: "-", workers: -1, format: "official", quantiles: quantiles("median,p99")},
+		},
+		{
+			args:     []string{"-rounding", "half-even", "-"},
+			expected: config{input: "-", workers: -1, format: "official", rounding: round.HalfEven},
+		},
+		{
+			args:     []string{"-hash", "maphash", "-"},
+			expected: config{input: "-", workers: -1, format: "official", hash: aggregate.HashMaphash},
+		},
+		{
+			args:     []string{"-stats", "-stats-json", "stats.json", "in.txt"},
+			expected: config{input: "in.txt", workers: -1, format: "official", stats: true, statsJSON: "stats.json"},
+		},
+		{
+			args:     []string{"-serve", ":8080", "in.txt"},
+			expected: config{input: "in.txt", workers: -1, format: "official", serve: ":8080"},
+		},
+		{
+			args:     []string{"-skip-invalid", "in.txt"},
+			expected: config{input: "in.txt", workers: -1, format: "official", strict: true, skipInvalid: true},
+		},
+		{args: []string{"a.txt", "b.txt"}, err: "expected at most one input file, got 2"},
+		{args: []string{"-workers", "0"}, err: "invalid -workers 0, must be at least 1"},
+		{args: []string{"-chunk-size", "-1"}, err: "invalid -chunk-size -1, must not be negative"},
+		{args: []string{"-format", "xml"}, err: `unknown -format "xml", must be one of: csv, json, lines, ndjson, official, snapshot`},
+		{args: []string{"-unknown"}, err: "flag provided but not defined: -unknown"},
+		{args: []string{"-quantiles", "p50,avg"}, err: `invalid -quantiles: invalid quantile "avg", must be median, mode or pN`},
+		{args: []string{"-hash", "md5"}, err: `invalid value "md5" for flag -hash: unknown hash "md5", must be one of: wyhash, maphash, fnv1a`},
+		{args: []string{"-rounding", "up"}, err: `invalid value "up" for flag -rounding: unknown rounding mode "up", must be one of: half-up, half-even, truncate`},
+	} {
+		cfg, err := parseFlags(tc.args, io.Discard)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Expected error %q for %v, got: %v", tc.err, tc.args, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", tc.args, err)
+			continue
+		}
+		if tc.expected.workers == -1 {
+			tc.expected.workers = cfg.workers
+		}
+		if !reflect.DeepEqual(cfg, tc.expected) {
+			t.Errorf("Wrong config for %v, expected: %+v, got: %+v", tc.args, tc.expected, cfg)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	input := filepath.Join(samplesDir, "measurements-3.txt")
+	output := filepath.Join(t.TempDir(), "out.txt")
+
+	for _, cfg := range []config{
+		{input: input, workers: 1, format: "official"},
+		{input: input, workers: 4, chunkSize: 16, format: "official"},
+		{input: input, output: output, workers: 2, format: "lines"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if err := run(cfg, nil, &stdout, &stderr); err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", cfg, err)
+		}
+
+		got, expected := stdout.String(), "{Bosaso=-15.0/1.3/20.0, Petropavlovsk-Kamchatsky=-9.5/0.0/9.5}\n"
+		if cfg.output != "" {
+			b, err := os.ReadFile(cfg.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, expected = string(b), "Bosaso;-15.0;1.3;20.0\nPetropavlovsk-Kamchatsky;-9.5;0.0;9.5\n"
+		}
+		if got != expected {
+			t.Errorf("Wrong output for %+v, expected:\n%s\ngot:\n%s", cfg, expected, got)
+		}
+		if !strings.Contains(stderr.String(), "Running with") {
+			t.Errorf("Expected diagnostics on stderr, got: %q", stderr.String())
+		}
+	}
+
+	if err := run(config{input: filepath.Join(t.TempDir(), "missing.txt"), workers: 1, format: "official"}, nil, io.Discard, io.Discard); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not exist error, got: %v", err)
+	}
+}
+
+func TestRunStrict(t *testing.T) {
+	const data = "a;1.0\nb;12345.6\na;3.0\n;1.0\n"
+	input := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(input, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []string{input, "-"} {
+		var stdout, stderr bytes.Buffer
+		err := run(config{input: in, workers: 2, format: "official", strict: true}, strings.NewReader(data), &stdout, &stderr)
+		if err == nil || err.Error() != "found 2 invalid lines" {
+			t.Errorf("Expected invalid lines error for %s, got: %v", in, err)
+		}
+		if expected := "Invalid line 2 at offset 6: value 12345.6 out of range\nInvalid line 4 at offset 22: empty name\n"; !strings.HasSuffix(stderr.String(), expected) {
+			t.Errorf("Expected invalid lines on stderr for %s, got: %q", in, stderr.String())
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("Unexpected output for %s: %s", in, stdout.String())
+		}
+
+		stdout.Reset()
+		stderr.Reset()
+		if err := run(config{input: in, workers: 2, format: "official", strict: true, skipInvalid: true}, strings.NewReader(data), &stdout, &stderr); err != nil {
+			t.Fatalf("Unexpected error for %s: %v", in, err)
+		}
+		if expected := "{a=1.0/2.0/3.0}\n"; stdout.String() != expected {
+			t.Errorf("Wrong output for %s, expected: %s, got: %s", in, expected, stdout.String())
+		}
+		if !strings.HasSuffix(stderr.String(), "Skipped 2 invalid lines\n") || strings.Contains(stderr.String(), "Invalid line") {
+			t.Errorf("Expected summary on stderr for %s, got: %q", in, stderr.String())
+		}
+	}
+}
+
+func TestRunLongNames(t *testing.T) {
+	// names longer than the buffers of the parsers and sharing prefixes
+	long := strings.Repeat("ä", 1000)
+	names := []string{long[:50], long[:51], long[:128], long[:128] + "b", long[:300], long, strings.Repeat("x", blockSize+1)}
+
+	expected := make(aggregate.Results)
+	var data strings.Builder
+	for i := range 3 {
+		for j, name := range names {
+			v := int64(i*10 + j)
+			expected.Add(name, v)
+			fmt.Fprintf(&data, "%s;%d.%d\n", name, v/10, v%10)
+		}
+	}
+	var out bytes.Buffer
+	if err := aggregate.WriteOfficial(&out, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	input := openData(t, data.String())
+	result := processChunk(input, 0, input.Len(), false, aggregate.HashWyhash)
+	if result.Len() != len(names) {
+		t.Errorf("Expected %d stations, got %d", len(names), result.Len())
+	}
+
+	filename := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, []byte(data.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []config{
+		{input: filename, workers: 3, chunkSize: 16, format: "official"},
+		{input: "-", workers: 3, chunkSize: 16, format: "official"},
+	} {
+		var stdout bytes.Buffer
+		if err := run(cfg, strings.NewReader(data.String()), &stdout, io.Discard); err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", cfg, err)
+		}
+		if stdout.String() != out.String() {
+			t.Errorf("Wrong output for %+v, expected:\n%s\ngot:\n%s", cfg, out.String(), stdout.String())
+		}
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sample := range samples {
+		data, err := os.ReadFile(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, format := range formatNames() {
+			qs := quantiles("p0,p50,p90,p99,median,mode")
+			var fromFile, fromStdin bytes.Buffer
+			if err := run(config{input: sample, workers: 2, format: format, quantiles: qs}, nil, &fromFile, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := config{input: "-", workers: 2, chunkSize: 1024, format: format, quantiles: qs}
+			if err := run(cfg, iotest.HalfReader(bytes.NewReader(data)), &fromStdin, io.Discard); err != nil {
+				t.Fatalf("Unexpected error for %s: %v", sample, err)
+			}
+			if fromStdin.String() != fromFile.String() {
+				t.Errorf("Wrong %s output for %s, expected:\n%s\ngot:\n%s", format, sample, fromFile.String(), fromStdin.String())
+			}
+		}
+	}
+
+	err = run(config{input: "-", workers: 1, format: "official"}, iotest.ErrReader(os.ErrClosed), io.Discard, io.Discard)
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected read error, got: %v", err)
+	}
+}
+
+func quantiles(s string) []aggregate.Quantile {
+	qs, err := aggregate.ParseQuantiles(s)
+	if err != nil {
+		panic(err)
+	}
+	return qs
+}
+
+func TestRunQuantiles(t *testing.T) {
+	cfg := config{input: filepath.Join(samplesDir, "measurements-3.txt"), workers: 2, chunkSize: 16, format: "lines", quantiles: quantiles("p50,median,mode")}
+
+	var stdout bytes.Buffer
+	if err := run(cfg, nil, &stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Bosaso;-15.0;1.3;20.0;-5.0;0.0;-15.0\nPetropavlovsk-Kamchatsky;-9.5;0.0;9.5;-9.5;0.0;-9.5\n"; stdout.String() != expected {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, stdout.String())
+	}
+}
+
+func TestRunRounding(t *testing.T) {
+	const data = "a;0.1\na;0.2\nb;-0.1\nb;-0.2\n"
+	input := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(input, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for m, expected := range map[round.Mode]string{
+		round.HalfUp:   "a;0.1;0.2;0.2\nb;-0.2;-0.1;-0.1\n",
+		round.HalfEven: "a;0.1;0.2;0.2\nb;-0.2;-0.2;-0.1\n",
+		round.Truncate: "a;0.1;0.1;0.2\nb;-0.2;-0.1;-0.1\n",
+	} {
+		var fromFile, fromStdin bytes.Buffer
+		if err := run(config{input: input, workers: 1, format: "lines", rounding: m}, nil, &fromFile, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err := run(config{input: "-", workers: 1, format: "lines", rounding: m}, strings.NewReader(data), &fromStdin, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if fromFile.String() != expected || fromStdin.String() != expected {
+			t.Errorf("Wrong %v output, expected:\n%s\ngot:\n%s\nand from stdin:\n%s", m, expected, fromFile.String(), fromStdin.String())
+		}
+	}
+}
+
+func TestRunHashes(t *testing.T) {
+	sample := filepath.Join(samplesDir, "measurements-complex-utf8.txt")
+	expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []aggregate.Hash{aggregate.HashWyhash, aggregate.HashMaphash, aggregate.HashFNV1a} {
+		var stdout bytes.Buffer
+		if err := run(config{input: sample, workers: 2, chunkSize: 64, format: "official", hash: hash}, nil, &stdout, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != string(expected) {
+			t.Errorf("Wrong %v output, expected:\n%s\ngot:\n%s", hash, expected, stdout.String())
+		}
+	}
+}
+
+func TestRunTableStats(t *testing.T) {
+	sample := filepath.Join(samplesDir, "measurements-10000-unique-keys.txt")
+	data, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, stdin := range map[string]io.Reader{"file": nil, "stdin": bytes.NewReader(data)} {
+		cfg := config{input: sample, workers: 2, chunkSize: 64 * 1024, format: "official", stats: true, statsJSON: filepath.Join(t.TempDir(), "stats.json")}
+		if stdin != nil {
+			cfg.input = "-"
+		}
+		var stderr bytes.Buffer
+		if err := run(cfg, stdin, io.Discard, &stderr); err != nil {
+			t.Fatal(err)
+		}
+
+		statsJSON, err := os.ReadFile(cfg.statsJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats []aggregate.TableStats
+		if err := json.Unmarshal(statsJSON, &stats); err != nil {
+			t.Fatal(err)
+		}
+		stations := 0
+		for _, s := range stats {
+			if s.Occupied != s.Stations || s.MaxProbe < 1 || s.AvgProbe < 1 {
+				t.Errorf("%s: wrong stats: %+v", name, s)
+			}
+			if s.Table != "merged" {
+				stations += s.Stations
+			}
+			if !strings.Contains(stderr.String(), fmt.Sprintf("%s: %d stations, ", s.Table, s.Stations)) {
+				t.Errorf("%s: missing %s in:\n%s", name, s.Table, stderr.String())
+			}
+		}
+		if len(stats) == 0 || stations < 10_000 {
+			t.Errorf("%s: expected stats of tables with 10000 stations, got: %+v", name, stats)
+		}
+		if last := stats[len(stats)-1]; stdin == nil && (last.Table != "merged" || last.Stations != 10_000) {
+			t.Errorf("%s: wrong stats of the merged table: %+v", name, last)
+		}
+	}
+}
+
+// BenchmarkProcessChunk aggregates 20 times the lines of the sample of 10000
+// stations by a single worker.
+func BenchmarkProcessChunk(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	filename := filepath.Join(b.TempDir(), "measurements.txt")
+	if err := os.WriteFile(filename, bytes.Repeat(data, 20), 0644); err != nil {
+		b.Fatal(err)
+	}
+	reader, err := mmap.Open(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer reader.Close()
+
+	b.SetBytes(int64(reader.Len()))
+	for i := 0; i < b.N; i++ {
+		processChunk(reader, 0, reader.Len(), false, aggregate.HashWyhash)
+	}
+}
+
+var readLineSink int64
+
+// BenchmarkReadLine splits the lines of a sample a word and a byte at a time.
+func BenchmarkReadLine(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-10000-unique-keys.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, read := range []struct {
+		name     string
+		readLine func([]byte) (int, int64, int, bool)
+	}{{"words", ReadLine}, {"bytes", readLineBytewise}} {
+		b.Run("read="+read.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var sum int64
+				for start := 0; start < len(data); {
+					nameLength, temperature, n, _ := read.readLine(data[start:])
+					sum += int64(nameLength) + temperature
+					start += n
+				}
+				readLineSink = sum
+			}
+		})
+	}
+}
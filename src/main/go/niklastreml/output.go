@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+	"golang.org/x/exp/mmap"
+)
+
+// formats maps the names accepted by -format to result writers
+var formats = map[string]func(w io.Writer, reader *mmap.ReaderAt, results []*Result, o aggregate.EncodeOptions) error{
+	"official": printResults,
+	"lines":    printLines,
+	"json":     encodeResults(aggregate.WriteJSON),
+	"ndjson":   encodeResults(aggregate.WriteNDJSON),
+	"csv":      encodeResults(aggregate.WriteCSV),
+	"snapshot": encodeResults(aggregate.Encoders["snapshot"]),
+}
+
+// streamFormats holds the writers for each of formats used when the input is
+// read from stdin and there is no file to take the names from
+var streamFormats = map[string]aggregate.Encoder{
+	"official": aggregate.WriteOfficialQuantiles,
+	"lines":    writeLines,
+	"json":     aggregate.WriteJSON,
+	"ndjson":   aggregate.WriteNDJSON,
+	"csv":      aggregate.WriteCSV,
+	"snapshot": aggregate.Encoders["snapshot"],
+}
+
+// encodeResults adapts an encoder of the aggregate package to results whose
+// names are in the mmapped file
+func encodeResults(enc aggregate.Encoder) func(w io.Writer, reader *mmap.ReaderAt, results []*Result, o aggregate.EncodeOptions) error {
+	return func(w io.Writer, reader *mmap.ReaderAt, results []*Result, o aggregate.EncodeOptions) error {
+		return enc(w, toResults(reader, results), o)
+	}
+}
+
+// toResults converts results to aggregate.Results with names copied out of
+// the mmapped file, the stats are shared. nil results are skipped.
+func toResults(reader *mmap.ReaderAt, results []*Result) aggregate.Results {
+	converted := make(aggregate.Results, len(results))
+	for _, v := range results {
+		if v == nil {
+			continue
+		}
+		name := make([]byte, v.NameLength)
+		reader.ReadAt(name, int64(v.NameAddr))
+		converted[string(name)] = &v.Stats
+	}
+	return converted
+}
+
+// printResults writes results sorted by name in the official format
+// {name=min/mean/max, ...} followed by a newline, the values of o.Quantiles
+// are appended to min/mean/max separated by '/'. nil results are skipped.
+func printResults(w io.Writer, reader *mmap.ReaderAt, results []*Result, o aggregate.EncodeOptions) error {
+	if err := checkOverflow(reader, results); err != nil {
+		return err
+	}
+	sortResults(reader, results)
+
+	out := bufio.NewWriter(w)
+	out.WriteByte('{')
+
+	// reused buffer for names, grown to the longest name
+	name := make([]byte, 0, 128)
+	var num []byte
+	for i, v := range results {
+		// nil results are sorted to the end, no more data will come after it
+		if v == nil {
+			break
+		}
+		if i > 0 {
+			out.WriteString(", ")
+		}
+
+		name = slices.Grow(name[:0], v.NameLength)[:v.NameLength]
+		reader.ReadAt(name, int64(v.NameAddr))
+		out.Write(name)
+		out.WriteByte('=')
+
+		num = aggregate.AppendStats(num[:0], &v.Stats, o.Rounding)
+		num = aggregate.AppendQuantiles(num, &v.Stats, o.Quantiles, '/')
+		out.Write(num)
+	}
+
+	out.WriteString("}\n")
+	return out.Flush()
+}
+
+// printLines writes results sorted by name, one name;min;mean;max line each
+// followed by the values of o.Quantiles
+func printLines(w io.Writer, reader *mmap.ReaderAt, results []*Result, o aggregate.EncodeOptions) error {
+	if err := checkOverflow(reader, results); err != nil {
+		return err
+	}
+	sortResults(reader, results)
+
+	out := bufio.NewWriter(w)
+
+	name := make([]byte, 0, 128)
+	var num []byte
+	for _, v := range results {
+		if v == nil {
+			break
+		}
+
+		name = slices.Grow(name[:0], v.NameLength)[:v.NameLength]
+		reader.ReadAt(name, int64(v.NameAddr))
+		out.Write(name)
+
+		num = appendLine(num[:0], &v.Stats, o)
+		out.Write(num)
+	}
+
+	return out.Flush()
+}
+
+// writeLines writes results sorted by name in the same format as printLines
+func writeLines(w io.Writer, results aggregate.Results, o aggregate.EncodeOptions) error {
+	stations := results.Sorted()
+	for _, s := range stations {
+		if s.Overflows() {
+			return fmt.Errorf("%w: %s", aggregate.ErrOverflow, s.Name)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+
+	var num []byte
+	for _, s := range stations {
+		out.WriteString(s.Name)
+
+		num = appendLine(num[:0], s.Stats, o)
+		out.Write(num)
+	}
+
+	return out.Flush()
+}
+
+// appendLine appends ;min;mean;max, the values of o.Quantiles and a newline
+// to b
+func appendLine(b []byte, s *aggregate.Stats, o aggregate.EncodeOptions) []byte {
+	b = append(b, ';')
+	b = aggregate.AppendTenths(b, s.Min)
+	b = append(b, ';')
+	b = aggregate.AppendTenths(b, s.MeanRounded(o.Rounding))
+	b = append(b, ';')
+	b = aggregate.AppendTenths(b, s.Max)
+	b = aggregate.AppendQuantiles(b, s, o.Quantiles, ';')
+	return append(b, '\n')
+}
+
+// checkOverflow returns aggregate.ErrOverflow for the first result whose sums
+// may have overflowed
+func checkOverflow(reader *mmap.ReaderAt, results []*Result) error {
+	for _, v := range results {
+		if v != nil && v.Overflows() {
+			name := make([]byte, v.NameLength)
+			reader.ReadAt(name, int64(v.NameAddr))
+			return fmt.Errorf("%w: %s", aggregate.ErrOverflow, name)
+		}
+	}
+	return nil
+}
+
+// sortResults sorts results by name, nil results go to the end
+func sortResults(reader *mmap.ReaderAt, results []*Result) {
+	slices.SortFunc(results, func(a, b *Result) int {
+		// ensure nil go to the end of the array
+		if a == nil {
+			return 1
+		}
+		if b == nil {
+			return -1
+		}
+		swapped := 1
+		if a.NameLength > b.NameLength {
+			a, b = b, a
+			swapped = -1
+		}
+
+		for i := range a.NameLength {
+			aName := a.NameAddr + i
+			bName := b.NameAddr + i
+
+			aByte, bByte := reader.At(aName), reader.At(bName)
+			if aByte < bByte {
+				return -1 * swapped
+			} else if aByte > bByte {
+				return 1 * swapped
+			}
+		}
+
+		if b.NameLength > a.NameLength {
+			// special case where a is a substring of b
+			// a = "Hamburg"
+			// b = "Hamburger"
+			// since a is always less than b, we declare that the longer string 'b' should be sorted
+			// after the shorter string 'a'
+			return -1 * swapped
+		}
+		return 0
+	})
+}
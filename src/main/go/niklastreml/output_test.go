@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+func TestPrintResultsSamples(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(samplesDir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatalf("No samples found in %s", samplesDir)
+	}
+
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			expected, err := os.ReadFile(strings.TrimSuffix(sample, ".txt") + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := openFile(t, sample)
+			result := processChunk(reader, 0, reader.Len(), false, aggregate.HashWyhash)
+
+			var out bytes.Buffer
+			if err := printResults(&out, reader, result.Data, aggregate.EncodeOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(expected) {
+				t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, out.String())
+			}
+		})
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	reader := openData(t, "Hamburger\nHamburg\nB\n")
+
+	hamburger := &Result{NameAddr: 0, NameLength: 9}
+	hamburg := &Result{NameAddr: 10, NameLength: 7}
+	b := &Result{NameAddr: 18, NameLength: 1}
+
+	results := []*Result{nil, hamburger, nil, hamburg, b}
+	sortResults(reader, results)
+
+	var names []string
+	for _, r := range results {
+		if r == nil {
+			names = append(names, "<nil>")
+		} else {
+			names = append(names, name(reader, r))
+		}
+	}
+	if got := strings.Join(names, ","); got != "B,Hamburg,Hamburger,<nil>,<nil>" {
+		t.Errorf("Wrong order: %s", got)
+	}
+}
+
+func TestPrintResultsOverflow(t *testing.T) {
+	reader := openData(t, "Hamburg;12.0\n")
+	result := processChunk(reader, 0, reader.Len(), false, aggregate.HashWyhash)
+	for _, v := range result.Data {
+		if v != nil {
+			v.Count = aggregate.MaxCount + 1
+		}
+	}
+
+	for name, format := range formats {
+		if name == "snapshot" { // keeps the sums as they are
+			continue
+		}
+		var out bytes.Buffer
+		if err := format(&out, reader, result.Data, aggregate.EncodeOptions{}); !errors.Is(err, aggregate.ErrOverflow) || out.Len() > 0 {
+			t.Errorf("Expected ErrOverflow and no %s output, got: %v %q", name, err, out.String())
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+const (
+	// default and maximum n of /top
+	defaultTopN = 10
+	maxTopN     = 10000
+
+	// maximum body size of /ingest
+	maxIngestBytes = 64 << 20
+)
+
+// server serves results over HTTP and merges ingested measurements into them
+//
+//	GET  /stations         all stations sorted by name
+//	GET  /stations/{name}  a single station
+//	GET  /top?by=max&n=10  the n stations with the highest min, mean, max,
+//	                       count, sum or quantile
+//	POST /ingest           adds the name;value lines of the body
+//
+// Stations are written as JSON or CSV depending on the Accept header, see
+// aggregate.WriteJSON and aggregate.WriteCSV.
+type server struct {
+	mu      sync.RWMutex
+	results aggregate.Results
+	hash    aggregate.Hash
+	options aggregate.EncodeOptions
+}
+
+// newServer serves results, ingested lines are hashed with hash like the
+// batch run
+func newServer(results aggregate.Results, hash aggregate.Hash, o aggregate.EncodeOptions) *server {
+	return &server{results: results, hash: hash, options: o}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stations", s.handleStations)
+	mux.HandleFunc("GET /stations/{name}", s.handleStation)
+	mux.HandleFunc("GET /top", s.handleTop)
+	mux.HandleFunc("POST /ingest", s.handleIngest)
+	return mux
+}
+
+// serve serves results on cfg.serve until interrupted
+func serve(cfg config, results aggregate.Results, stderr io.Writer) error {
+	ln, err := net.Listen("tcp", cfg.serve)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stderr, "Serving results on", ln.Addr())
+
+	srv := &http.Server{Handler: newServer(results, cfg.hash, cfg.encodeOptions()).handler()}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdown
+}
+
+func (s *server) handleStations(w http.ResponseWriter, r *http.Request) {
+	s.respond(w, r, false, func(results aggregate.Results) ([]aggregate.Station, bool) {
+		return results.Sorted(), true
+	})
+}
+
+func (s *server) handleStation(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.respond(w, r, true, func(results aggregate.Results) ([]aggregate.Station, bool) {
+		st := results[name]
+		if st == nil {
+			return nil, false
+		}
+		return []aggregate.Station{{Name: name, Stats: st}}, true
+	})
+}
+
+func (s *server) handleTop(w http.ResponseWriter, r *http.Request) {
+	by := r.FormValue("by")
+	if by == "" {
+		by = "max"
+	}
+	key := s.topKey(by)
+	if key == nil {
+		http.Error(w, fmt.Sprintf("invalid by %q, must be one of: %s", by, strings.Join(s.topKeys(), ", ")), http.StatusBadRequest)
+		return
+	}
+
+	n := defaultTopN
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxTopN {
+			http.Error(w, fmt.Sprintf("invalid n %q, must be between 1 and %d", v, maxTopN), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.respond(w, r, false, func(results aggregate.Results) ([]aggregate.Station, bool) {
+		stations := results.Sorted()
+		// stable to order equal values by name
+		slices.SortStableFunc(stations, func(a, b aggregate.Station) int {
+			return -cmpInt64(key(a.Stats), key(b.Stats))
+		})
+		return stations[:min(n, len(stations))], true
+	})
+}
+
+// topKeys returns the names accepted by topKey
+func (s *server) topKeys() []string {
+	keys := []string{"min", "mean", "max", "count", "sum"}
+	for _, q := range s.options.Quantiles {
+		keys = append(keys, q.Name)
+	}
+	return keys
+}
+
+// topKey returns the value to rank stations by for the by parameter of /top
+func (s *server) topKey(by string) func(st *aggregate.Stats) int64 {
+	switch by {
+	case "min":
+		return func(st *aggregate.Stats) int64 { return st.Min }
+	case "mean":
+		return func(st *aggregate.Stats) int64 { return st.MeanRounded(s.options.Rounding) }
+	case "max":
+		return func(st *aggregate.Stats) int64 { return st.Max }
+	case "count":
+		return func(st *aggregate.Stats) int64 { return st.Count }
+	case "sum":
+		return func(st *aggregate.Stats) int64 { return st.Sum }
+	}
+	for _, q := range s.options.Quantiles {
+		if q.Name == by {
+			return func(st *aggregate.Stats) int64 { return q.Value(st.Histogram) }
+		}
+	}
+	return nil
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// handleIngest merges the measurements of the body into the results. The body
+// is merged only if all of it is valid. Every request is processed by a single
+// worker, concurrent requests are processed in parallel already.
+func (s *server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, maxIngestBytes)
+	results, err := aggregate.ProcessReader(r.Context(), body, aggregate.Options{
+		Concurrency: 1,
+		Histograms:  len(s.options.Quantiles) > 0,
+		Hash:        s.hash,
+	})
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, aggregate.ErrMalformed):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.results.Merge(results)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respond writes the stations selected from the results in the representation
+// negotiated by the Accept header of r, single writes a station on its own
+// rather than a list. Stations which are not found are reported as 404.
+func (s *server) respond(w http.ResponseWriter, r *http.Request, single bool, selectStations func(aggregate.Results) ([]aggregate.Station, bool)) {
+	rep, ok := negotiate(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "not acceptable, supported are: application/json, text/csv", http.StatusNotAcceptable)
+		return
+	}
+	write := rep.list
+	if single {
+		write = rep.single
+	}
+
+	// written into a buffer to not block ingestion on slow clients
+	var buf bytes.Buffer
+	s.mu.RLock()
+	stations, found := selectStations(s.results)
+	var err error
+	if found {
+		err = write(&buf, stations, s.options)
+	}
+	s.mu.RUnlock()
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", rep.contentType)
+	w.Header().Add("Vary", "Accept")
+	w.Write(buf.Bytes())
+}
+
+// representation writes stations as a media type
+type representation struct {
+	mediaType, contentType string
+	list, single           func(w io.Writer, stations []aggregate.Station, o aggregate.EncodeOptions) error
+}
+
+// representations in order of preference
+var representations = []representation{
+	{"application/json", "application/json", aggregate.WriteJSONStations, aggregate.WriteNDJSONStations},
+	{"text/csv", "text/csv; charset=utf-8", aggregate.WriteCSVStations, aggregate.WriteCSVStations},
+}
+
+// negotiate returns the representation with the highest quality in the
+// Accept header, JSON without header, or false if none is acceptable
+func negotiate(accept string) (representation, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return representations[0], true
+	}
+
+	// quality of each representation by the most specific matching range
+	quality := make([]float64, len(representations))
+	specificity := make([]int, len(representations))
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		for i, rep := range representations {
+			spec := mediaRangeMatch(mediaRange, rep.mediaType)
+			if spec > specificity[i] {
+				specificity[i], quality[i] = spec, q
+			}
+		}
+	}
+
+	best := -1
+	for i, q := range quality {
+		if q > 0 && (best < 0 || q > quality[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return representation{}, false
+	}
+	return representations[best], true
+}
+
+// mediaRangeMatch returns how specific mediaRange matches mediaType, 0 if it
+// does not
+func mediaRangeMatch(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	if mediaRange == typ+"/*" {
+		return 2
+	}
+	return 0
+}
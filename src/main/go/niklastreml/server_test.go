@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/niklastreml/1brc-go/src/main/go/aggregate"
+)
+
+// newTestServer serves the results of the given sample with quantiles
+func newTestServer(t *testing.T, sample string, qs []aggregate.Quantile) *httptest.Server {
+	t.Helper()
+
+	reader := openFile(t, filepath.Join(samplesDir, sample))
+	result := processChunk(reader, 0, reader.Len(), len(qs) > 0, aggregate.HashWyhash)
+
+	ts := httptest.NewServer(newServer(toResults(reader, result.Data), aggregate.HashWyhash, aggregate.EncodeOptions{Quantiles: qs}).handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// get requests path with the given Accept header and returns the status,
+// content type and body
+func get(t *testing.T, ts *httptest.Server, path, accept string) (int, string, string) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return do(t, req)
+}
+
+func post(t *testing.T, ts *httptest.Server, path, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, respBody := do(t, req)
+	return status, respBody
+}
+
+func do(t *testing.T, req *http.Request) (int, string, string) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+}
+
+// encode returns the output of enc for r
+func encode(t *testing.T, enc aggregate.Encoder, r aggregate.Results, qs []aggregate.Quantile) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := enc(&out, r, aggregate.EncodeOptions{Quantiles: qs}); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestServerStations(t *testing.T) {
+	const sample = "measurements-complex-utf8.txt"
+	qs := quantiles("p50,mode")
+	ts := newTestServer(t, sample, qs)
+
+	reader := openFile(t, filepath.Join(samplesDir, sample))
+	expected := toResults(reader, processChunk(reader, 0, reader.Len(), true, aggregate.HashWyhash).Data)
+
+	for _, tc := range []struct {
+		accept, contentType string
+		enc                 aggregate.Encoder
+	}{
+		{"", "application/json", aggregate.WriteJSON},
+		{"*/*", "application/json", aggregate.WriteJSON},
+		{"application/json", "application/json", aggregate.WriteJSON},
+		{"text/csv", "text/csv; charset=utf-8", aggregate.WriteCSV},
+		{"text/*", "text/csv; charset=utf-8", aggregate.WriteCSV},
+		{"application/json;q=0.5, text/csv", "text/csv; charset=utf-8", aggregate.WriteCSV},
+		{"text/csv;q=0.1, */*;q=0.5", "application/json", aggregate.WriteJSON},
+		{"text/html, */*;q=0.1", "application/json", aggregate.WriteJSON},
+	} {
+		status, contentType, body := get(t, ts, "/stations", tc.accept)
+		if status != http.StatusOK || contentType != tc.contentType {
+			t.Errorf("Expected %s for Accept %q, got: %d %s", tc.contentType, tc.accept, status, contentType)
+			continue
+		}
+		if e := encode(t, tc.enc, expected, qs); body != e {
+			t.Errorf("Wrong body for Accept %q, expected:\n%s\ngot:\n%s", tc.accept, e, body)
+		}
+	}
+
+	for _, accept := range []string{"text/html", "application/json;q=0, text/csv;q=0", "image/*"} {
+		if status, _, _ := get(t, ts, "/stations", accept); status != http.StatusNotAcceptable {
+			t.Errorf("Expected status 406 for Accept %q, got: %d", accept, status)
+		}
+	}
+}
+
+func TestServerStation(t *testing.T) {
+	const sample = "measurements-complex-utf8.txt"
+	ts := newTestServer(t, sample, nil)
+
+	reader := openFile(t, filepath.Join(samplesDir, sample))
+	expected := toResults(reader, processChunk(reader, 0, reader.Len(), false, aggregate.HashWyhash).Data)
+
+	for _, st := range expected.Sorted()[:3] {
+		single := aggregate.Results{st.Name: st.Stats}
+		for accept, enc := range map[string]aggregate.Encoder{
+			"application/json": aggregate.WriteNDJSON,
+			"text/csv":         aggregate.WriteCSV,
+		} {
+			status, _, body := get(t, ts, "/stations/"+url.PathEscape(st.Name), accept)
+			if status != http.StatusOK {
+				t.Fatalf("Expected status 200 for %q, got: %d %s", st.Name, status, body)
+			}
+			if e := encode(t, enc, single, nil); body != e {
+				t.Errorf("Wrong %s station, expected:\n%s\ngot:\n%s", accept, e, body)
+			}
+		}
+	}
+
+	if status, _, _ := get(t, ts, "/stations/Atlantis", ""); status != http.StatusNotFound {
+		t.Errorf("Expected status 404, got: %d", status)
+	}
+}
+
+func TestServerTop(t *testing.T) {
+	ts := newTestServer(t, "measurements-10.txt", quantiles("p50"))
+
+	topNames := func(path string) string {
+		t.Helper()
+		status, _, body := get(t, ts, path, "text/csv")
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got: %d %s", path, status, body)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n")[1:] {
+			name, _, _ := strings.Cut(line, ",")
+			names = append(names, name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for path, expected := range map[string]string{
+		"/top?by=max&n=3":    "Tauranga,Ségou,Xi'an",
+		"/top?n=2":           "Tauranga,Ségou",
+		"/top?by=min&n=1":    "Tauranga",
+		"/top?by=p50&n=2":    "Tauranga,Ségou",
+		"/top?by=count&n=3":  "Adelaide,Cabo San Lucas,Dodoma",
+		"/top?by=mean&n=100": "Tauranga,Ségou,Xi'an,Dodoma,Karachi,Adelaide,Cabo San Lucas,Halifax,Zagreb,Pittsburgh",
+	} {
+		if names := topNames(path); names != expected {
+			t.Errorf("Wrong stations for %s, expected: %s, got: %s", path, expected, names)
+		}
+	}
+
+	for _, path := range []string{"/top?by=name", "/top?by=p99", "/top?n=0", "/top?n=x", "/top?n=10001"} {
+		if status, _, _ := get(t, ts, path, ""); status != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got: %d", path, status)
+		}
+	}
+}
+
+func TestServerIngest(t *testing.T) {
+	qs := quantiles("median")
+	ts := newTestServer(t, "measurements-3.txt", qs)
+
+	const ingested = "Bosaso;40.0\nOslo;-3.5\nOslo;1.0\n"
+	status, body := post(t, ts, "/ingest", ingested)
+	if status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got: %d %s", status, body)
+	}
+
+	// invalid input is not merged at all
+	for _, invalid := range []string{"Oslo;1.0\nOslo", "Oslo;1.0\n" + strings.Repeat("x", 1<<20)} {
+		if status, _ := post(t, ts, "/ingest", invalid); status != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got: %d", status)
+		}
+	}
+
+	// concurrent ingestion
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, body := post(t, ts, "/ingest", fmt.Sprintf("Oslo;%d.0\n", i)); status != http.StatusNoContent {
+				t.Errorf("Expected status 204, got: %d %s", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the same as processing all lines at once
+	data, err := os.ReadFile(filepath.Join(samplesDir, "measurements-3.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := string(data) + ingested
+	for i := range 10 {
+		all += fmt.Sprintf("Oslo;%d.0\n", i)
+	}
+	expected, err := aggregate.ProcessBytes(context.Background(), []byte(all), aggregate.Options{Histograms: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _, body = get(t, ts, "/stations", "text/csv")
+	if e := encode(t, aggregate.WriteCSV, expected, qs); status != http.StatusOK || body != e {
+		t.Errorf("Wrong stations after ingestion, expected:\n%s\ngot: %d\n%s", e, status, body)
+	}
+}
+
+func TestServerIngestMatchesRun(t *testing.T) {
+	const sample = "measurements-10000-unique-keys.txt"
+	qs := quantiles("p50,p99")
+	data, err := os.ReadFile(filepath.Join(samplesDir, sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range aggregate.HashNames() {
+		var hash aggregate.Hash
+		if err := hash.Set(name); err != nil {
+			t.Fatal(err)
+		}
+
+		var batch bytes.Buffer
+		cfg := config{input: filepath.Join(samplesDir, sample), workers: 2, format: "csv", quantiles: qs, hash: hash}
+		if err := run(cfg, nil, &batch, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		// the lines ingested in bodies of about 64KiB
+		ts := httptest.NewServer(newServer(make(aggregate.Results), hash, cfg.encodeOptions()).handler())
+		for rest := data; len(rest) > 0; {
+			n := min(len(rest), 64<<10)
+			n += bytes.IndexByte(rest[n-1:], '\n')
+			if status, body := post(t, ts, "/ingest", string(rest[:n])); status != http.StatusNoContent {
+				t.Fatalf("Expected status 204 with hash %s, got: %d %s", name, status, body)
+			}
+			rest = rest[n:]
+		}
+
+		status, _, body := get(t, ts, "/stations", "text/csv")
+		ts.Close()
+		if status != http.StatusOK || body != batch.String() {
+			t.Errorf("Ingested stations with hash %s differ from the batch run, got: %d\n%.500s", name, status, body)
+		}
+	}
+}